@@ -0,0 +1,169 @@
+package grpc_krb
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/resolver"
+)
+
+// spnHostKey is the resolver address attribute holding the host to use in the SPN for calls to the address.
+type spnHostKey struct{}
+
+// WithSPNHost returns the address with the host to use in the SPN for calls sent to it.
+// Resolvers use this to give each backend its own SPN when the client interceptor has PerAddressSPN set.
+func WithSPNHost(addr resolver.Address, host string) resolver.Address {
+	addr.Attributes = addr.Attributes.WithValues(spnHostKey{}, host)
+	return addr
+}
+
+// AddressCredentials wraps transport credentials so that the address each connection is made to is available when
+// choosing the SPN for the calls sent on it. Passing nil gives connections without transport security.
+// Connections must be dialled with these credentials for the PerAddressSPN setting of the client interceptor to work.
+func AddressCredentials(creds credentials.TransportCredentials) credentials.TransportCredentials {
+	return &addressCredentials{creds: creds}
+}
+
+type addressCredentials struct {
+	creds credentials.TransportCredentials
+}
+
+// AddressAuthInfo is the credentials.AuthInfo of connections made with AddressCredentials.
+// It records the address connected to and embeds the AuthInfo of the wrapped transport credentials, which is nil without transport security.
+type AddressAuthInfo struct {
+	credentials.AuthInfo
+	// ServerName is the server name of the address, or the authority of the connection if the address has none.
+	ServerName string
+	// Addr is the remote address of the connection.
+	Addr net.Addr
+	// SPNHost is the host set on the address with WithSPNHost.
+	SPNHost string
+}
+
+func (a *AddressAuthInfo) AuthType() string {
+	if a.AuthInfo == nil {
+		return "insecure"
+	}
+	return a.AuthInfo.AuthType()
+}
+
+// GetCommonAuthInfo returns the security level of the wrapped AuthInfo.
+func (a *AddressAuthInfo) GetCommonAuthInfo() credentials.CommonAuthInfo {
+	if c, ok := a.AuthInfo.(interface {
+		GetCommonAuthInfo() credentials.CommonAuthInfo
+	}); ok {
+		return c.GetCommonAuthInfo()
+	}
+	return credentials.CommonAuthInfo{SecurityLevel: credentials.NoSecurity}
+}
+
+func (c *addressCredentials) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	ai := &AddressAuthInfo{
+		ServerName: authority,
+		Addr:       conn.RemoteAddr(),
+	}
+	if h, ok := credentials.ClientHandshakeInfoFromContext(ctx).Attributes.Value(spnHostKey{}).(string); ok {
+		ai.SPNHost = h
+	}
+	if c.creds == nil {
+		return conn, ai, nil
+	}
+	conn, authInfo, err := c.creds.ClientHandshake(ctx, authority, conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	ai.AuthInfo = authInfo
+	return conn, ai, nil
+}
+
+func (c *addressCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	if c.creds == nil {
+		return conn, nil, nil
+	}
+	return c.creds.ServerHandshake(conn)
+}
+
+func (c *addressCredentials) Info() credentials.ProtocolInfo {
+	if c.creds == nil {
+		return credentials.ProtocolInfo{SecurityProtocol: "insecure"}
+	}
+	return c.creds.Info()
+}
+
+func (c *addressCredentials) Clone() credentials.TransportCredentials {
+	if c.creds == nil {
+		return &addressCredentials{}
+	}
+	return &addressCredentials{creds: c.creds.Clone()}
+}
+
+func (c *addressCredentials) OverrideServerName(name string) error {
+	if c.creds == nil {
+		return nil
+	}
+	return c.creds.OverrideServerName(name)
+}
+
+// addressHost returns the host for the SPN of calls sent on the connection.
+// The host set with WithSPNHost is used as it is. Otherwise with CanonicalizeRDNS the name is looked up from the address
+// connected to, or else the server name of the connection is canonicalized as set by DNSCanonicalization.
+func (i *KRBClientInterceptor) addressHost(ctx context.Context, ai *AddressAuthInfo) (string, error) {
+	if ai.SPNHost != "" {
+		return strings.TrimSuffix(strings.ToLower(ai.SPNHost), "."), nil
+	}
+	if i.DNSCanonicalization == CanonicalizeRDNS {
+		if a, ok := ai.Addr.(*net.TCPAddr); ok {
+			return i.canonicalHost(ctx, a.IP.String())
+		}
+	}
+	host := strings.TrimSuffix(strings.ToLower(endpointHost(ai.ServerName)), ".")
+	if host == "" {
+		return "", authError(codes.Unauthenticated, ReasonNoSPN, "could not derive a host for the SPN from the connection to %v", ai.Addr)
+	}
+	return i.canonicalHost(ctx, host)
+}
+
+// pickedCredentials creates the token for a call once the balancer has picked the connection it is sent on.
+// The token, or the error creating it, is kept for the interceptor to use once the call returns.
+type pickedCredentials struct {
+	i      *KRBClientInterceptor
+	mutual bool
+
+	mux sync.Mutex
+	tkn *krbToken
+	err error
+}
+
+func (c *pickedCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	ri, _ := credentials.RequestInfoFromContext(ctx)
+	ai, ok := ri.AuthInfo.(*AddressAuthInfo)
+	var tkn *krbToken
+	var err error
+	if ok {
+		tkn, err = c.i.token(ctx, "", ri.Method, c.mutual, ai)
+	} else {
+		err = authError(codes.Internal, ReasonInternal, "PerAddressSPN requires the connection to be dialled with AddressCredentials")
+	}
+	c.mux.Lock()
+	c.tkn, c.err = tkn, err
+	c.mux.Unlock()
+	if err != nil || tkn == nil {
+		return nil, err
+	}
+	return map[string]string{MDField: tkn.value}, nil
+}
+
+func (c *pickedCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+// result returns the token created for the latest attempt of the call.
+func (c *pickedCredentials) result() (*krbToken, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.tkn, c.err
+}
@@ -0,0 +1,118 @@
+package grpc_krb
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/grpckrb/test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+	"google.golang.org/grpc/status"
+)
+
+// newSPNTestServer starts a server that only holds the key for the SPN.
+func newSPNTestServer(t *testing.T, spn string) (*grpc.Server, net.Addr) {
+	kt, err := testKDC.AddPrincipal(spn)
+	if err != nil {
+		t.Fatalf("could not add principal %s: %v", spn, err)
+	}
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	si := &KRBServerInterceptor{Settings: service.NewSettings(kt, service.Logger(log.New(os.Stdout, "KRB: ", log.LstdFlags)))}
+	s := grpc.NewServer(grpc.UnaryInterceptor(si.Unary()), grpc.StreamInterceptor(si.Stream()))
+	test.RegisterServiceServer(s, new(test.Server))
+	go s.Serve(lis)
+	return s, lis.Addr()
+}
+
+func TestPerAddressSPN(t *testing.T) {
+	srv1, addr1 := newSPNTestServer(t, "GRPC/node1.test.gokrb5")
+	defer srv1.Stop()
+	srv2, addr2 := newSPNTestServer(t, "GRPC/node2.test.gokrb5")
+	defer srv2.Stop()
+
+	r := manual.NewBuilderWithScheme("spntest")
+	r.InitialState(resolver.State{Addresses: []resolver.Address{
+		{Addr: addr1.String(), ServerName: "node1.test.gokrb5"},
+		WithSPNHost(resolver.Address{Addr: addr2.String()}, "node2.test.gokrb5"),
+	}})
+	dial := func(ci *KRBClientInterceptor) *grpc.ClientConn {
+		conn, err := grpc.Dial(r.Scheme()+":///backends",
+			grpc.WithResolvers(r),
+			grpc.WithTransportCredentials(AddressCredentials(nil)),
+			grpc.WithDefaultServiceConfig(`{"loadBalancingConfig":[{"round_robin":{}}]}`),
+			grpc.WithUnaryInterceptor(ci.Unary()),
+			grpc.WithStreamInterceptor(ci.Stream()),
+		)
+		if err != nil {
+			t.Fatalf("could not create client connection: %v", err)
+		}
+		return conn
+	}
+
+	ci := newClientInterceptor("", "testuser1")
+	ci.DefaultSPN = ""
+	ci.PerAddressSPN = true
+	ci.MutualAuth = true
+	defer ci.Close()
+	conn := dial(ci)
+	defer conn.Close()
+	client := test.NewServiceClient(conn)
+
+	// round robin sends the calls to both backends, each of which only accepts tickets for its own SPN
+	peers := make(map[string]bool)
+	for n := 0; n < 4; n++ {
+		var p peer.Peer
+		_, err := client.Reflector(context.Background(), &test.Request{RequestInt: 1}, grpc.WaitForReady(true), grpc.Peer(&p))
+		if err != nil {
+			t.Fatalf("call %d failed: %v", n, err)
+		}
+		peers[p.Addr.String()] = true
+	}
+	if !peers[addr1.String()] || !peers[addr2.String()] {
+		t.Errorf("calls were not sent to both backends: %v", peers)
+	}
+	for n := 0; n < 2; n++ {
+		stream, err := client.Mirror(context.Background())
+		if err != nil {
+			t.Fatalf("could not create client stream: %v", err)
+		}
+		stream.CloseSend()
+		if _, err := stream.Recv(); err != io.EOF {
+			t.Errorf("error receiving from stream: %v", err)
+		}
+	}
+
+	// the SPN derived from the target is not known to the KDC
+	ci = newClientInterceptor("", "testuser1")
+	ci.DefaultSPN = ""
+	defer ci.Close()
+	conn2 := dial(ci)
+	defer conn2.Close()
+	_, err := test.NewServiceClient(conn2).Reflector(context.Background(), &test.Request{RequestInt: 1})
+	if status.Code(err) != codes.Unauthenticated || ErrorReason(err) != ReasonWrongSPN {
+		t.Errorf("expected the KDC to reject the SPN from the target, got: %v", err)
+	}
+
+	// token errors are returned as they are rather than hidden by GRPC
+	ci = newClientInterceptor("", "testuser1")
+	ci.SPNRules = []SPNRule{{Match: "*", SPN: "{package}/{host}"}}
+	ci.PerAddressSPN = true
+	defer ci.Close()
+	conn3 := dial(ci)
+	defer conn3.Close()
+	_, err = test.NewServiceClient(conn3).Reflector(context.Background(), &test.Request{RequestInt: 1}, grpc.WaitForReady(true))
+	if ErrorReason(err) != ReasonNoSPN {
+		t.Errorf("expected the token error to be returned, got: %v", err)
+	}
+}
@@ -0,0 +1,213 @@
+package grpc_krb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"google.golang.org/grpc/codes"
+)
+
+// ccacheCheckInterval is how often the credential cache is read again to pick up a TGT renewed outside of the process.
+const ccacheCheckInterval = 30 * time.Second
+
+// NewKRBClientInterceptorFromCCache returns a client interceptor using the TGT in a credential cache, such as one created by kinit.
+// The name is given as in KRB5CCNAME, either a path or a FILE: or DIR: cache. If empty KRB5CCNAME is used,
+// defaulting to /tmp/krb5cc_<uid>. If cfg is nil the krb5.conf named by KRB5_CONFIG, or /etc/krb5.conf, is loaded.
+// The cache is read again when it changes, so tickets renewed with kinit are picked up. Once the TGT has expired
+// calls fail with the CREDENTIALS_EXPIRED reason until kinit is run.
+func NewKRBClientInterceptorFromCCache(name string, cfg *config.Config, settings ...func(*client.Settings)) (*KRBClientInterceptor, error) {
+	if cfg == nil {
+		var err error
+		cfg, err = loadConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+	src := &ccacheSource{name: name}
+	cc, _, err := src.load()
+	if err != nil {
+		return nil, err
+	}
+	src.last, err = src.tgt(cc)
+	if err != nil {
+		return nil, err
+	}
+	cl, err := client.NewFromCCache(cc, cfg, settings...)
+	if err != nil {
+		return nil, fmt.Errorf("could not create client from credential cache %s: %v", src.path, err)
+	}
+	src.cname = cc.DefaultPrincipal.PrincipalName.PrincipalNameString() + "@" + cc.DefaultPrincipal.Realm
+	return &KRBClientInterceptor{KRBClient: cl, ccache: src}, nil
+}
+
+// ccacheSource reads the TGT for the ticket cache from a credential cache rather than logging in to the KDC.
+type ccacheSource struct {
+	name string
+	// cname is the client principal the interceptor was created for
+	cname string
+
+	mux     sync.Mutex
+	path    string
+	modTime time.Time
+	size    int64
+	last    *cachedTicket
+}
+
+// login returns the TGT from the credential cache, reading it again if it has changed.
+func (s *ccacheSource) login() (*cachedTicket, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	cc, changed, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	if !changed && s.last != nil {
+		if !s.last.valid(now) {
+			return nil, s.expired(s.last.endTime)
+		}
+		t := *s.last
+		t.nextRenew = nextCCacheCheck(now, t.endTime)
+		return &t, nil
+	}
+	if cname := cc.DefaultPrincipal.PrincipalName.PrincipalNameString() + "@" + cc.DefaultPrincipal.Realm; cname != s.cname {
+		return nil, authError(codes.Unauthenticated, ReasonCredentialsRejected,
+			"credential cache %s now holds tickets for %s rather than %s", s.path, cname, s.cname)
+	}
+	t, err := s.tgt(cc)
+	if err != nil {
+		return nil, err
+	}
+	s.last = t
+	// the ticket cache updates its own copy
+	c := *t
+	return &c, nil
+}
+
+// load reads the credential cache if it has changed since last read, reporting whether it had.
+func (s *ccacheSource) load() (cc *credentials.CCache, changed bool, err error) {
+	path, err := ccachePath(s.name)
+	if err != nil {
+		return nil, false, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, false, authError(codes.Unauthenticated, ReasonCredentialsExpired,
+			"could not read credential cache %s, run kinit to obtain tickets: %v", path, err)
+	}
+	if path == s.path && fi.ModTime().Equal(s.modTime) && fi.Size() == s.size {
+		return nil, false, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false, authError(codes.Unauthenticated, ReasonCredentialsExpired,
+			"could not read credential cache %s, run kinit to obtain tickets: %v", path, err)
+	}
+	cc, err = unmarshalCCache(b)
+	if err != nil {
+		return nil, false, authError(codes.Unauthenticated, ReasonCredentialsRejected, "could not parse credential cache %s: %v", path, err)
+	}
+	s.path, s.modTime, s.size = path, fi.ModTime(), fi.Size()
+	return cc, true, nil
+}
+
+// tgt returns the unexpired TGT held in the credential cache.
+func (s *ccacheSource) tgt(cc *credentials.CCache) (*cachedTicket, error) {
+	realm := cc.DefaultPrincipal.Realm
+	cred, ok := cc.GetEntry(types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt/"+realm))
+	if !ok {
+		return nil, authError(codes.Unauthenticated, ReasonCredentialsExpired,
+			"no TGT for %s in credential cache %s, run kinit to obtain one", realm, s.path)
+	}
+	now := time.Now().UTC()
+	if !now.Before(cred.EndTime) {
+		return nil, s.expired(cred.EndTime)
+	}
+	var tkt messages.Ticket
+	if err := tkt.Unmarshal(cred.Ticket); err != nil {
+		return nil, authError(codes.Unauthenticated, ReasonCredentialsRejected, "TGT in credential cache %s is not valid: %v", s.path, err)
+	}
+	return &cachedTicket{
+		tkt:       tkt,
+		key:       cred.Key,
+		flags:     cred.TicketFlags,
+		authTime:  cred.AuthTime,
+		startTime: cred.StartTime,
+		endTime:   cred.EndTime,
+		renewTill: cred.RenewTill,
+		fetched:   now,
+		nextRenew: nextCCacheCheck(now, cred.EndTime),
+	}, nil
+}
+
+func (s *ccacheSource) expired(endTime time.Time) error {
+	return authError(codes.Unauthenticated, ReasonCredentialsExpired,
+		"TGT in credential cache %s expired at %s, run kinit to obtain a new one", s.path, endTime.Local().Format(time.RFC3339))
+}
+
+// nextCCacheCheck returns when the credential cache is next to be read for a renewed TGT.
+func nextCCacheCheck(now, endTime time.Time) time.Time {
+	next := now.Add(ccacheCheckInterval)
+	if endTime.Before(next) {
+		return endTime
+	}
+	return next
+}
+
+// unmarshalCCache parses a credential cache. The gokrb5 parser does not check lengths so a truncated cache is recovered from.
+func unmarshalCCache(b []byte) (cc *credentials.CCache, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("credential cache is truncated or corrupt: %v", r)
+		}
+	}()
+	if len(b) < 2 {
+		return nil, fmt.Errorf("credential cache is truncated")
+	}
+	cc = new(credentials.CCache)
+	err = cc.Unmarshal(b)
+	return cc, err
+}
+
+// ccachePath returns the path of the credential cache file for a name as given in KRB5CCNAME.
+// For a DIR: collection the primary cache named in its primary file is used.
+func ccachePath(name string) (string, error) {
+	if name == "" {
+		name = os.Getenv("KRB5CCNAME")
+	}
+	if name == "" {
+		return fmt.Sprintf("/tmp/krb5cc_%d", os.Getuid()), nil
+	}
+	n := strings.Index(name, ":")
+	if n < 0 {
+		return name, nil
+	}
+	residual := name[n+1:]
+	switch strings.ToUpper(name[:n]) {
+	case "FILE":
+		return residual, nil
+	case "DIR":
+		if strings.HasPrefix(residual, ":") {
+			// a single cache within a collection
+			return residual[1:], nil
+		}
+		primary := "tkt"
+		b, err := ioutil.ReadFile(filepath.Join(residual, "primary"))
+		if err == nil && strings.TrimSpace(string(b)) != "" {
+			primary = strings.TrimSpace(string(b))
+		}
+		return filepath.Join(residual, primary), nil
+	}
+	return "", fmt.Errorf("credential cache type of %s is not supported, only FILE and DIR caches can be used", name)
+}
@@ -0,0 +1,99 @@
+package grpc_krb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewKRBClientInterceptorFromCCache(t *testing.T) {
+	srv, addr, _ := newTestServer(0)
+	if srv == nil {
+		t.Fatal("could not create grpc server")
+	}
+	defer srv.Stop()
+	cfg, err := testKDC.Config()
+	if err != nil {
+		t.Fatalf("could not get KDC config: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "grpckrb")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	// kinit writes the credential cache for the user
+	kinit := func(path string) {
+		b, err := testKDC.CCache("testuser1")
+		if err != nil {
+			t.Fatalf("could not create credential cache: %v", err)
+		}
+		if err := ioutil.WriteFile(path, b, 0600); err != nil {
+			t.Fatalf("could not write credential cache: %v", err)
+		}
+	}
+	call := func(ci *KRBClientInterceptor) error {
+		ci.DefaultSPN = "HTTP/host.test.gokrb5"
+		_, err := sendUnaryMessageWithInterceptor(addr.String(), ci)
+		return err
+	}
+
+	path := filepath.Join(dir, "krb5cc")
+	kinit(path)
+	ci, err := NewKRBClientInterceptorFromCCache("FILE:"+path, cfg)
+	if err != nil {
+		t.Fatalf("could not create client interceptor from FILE ccache: %v", err)
+	}
+	if err := call(ci); err != nil {
+		t.Errorf("call with TGT from FILE ccache failed: %v", err)
+	}
+	ci.Close()
+
+	collection := filepath.Join(dir, "collection")
+	if err := os.Mkdir(collection, 0700); err != nil {
+		t.Fatalf("could not create ccache collection: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(collection, "primary"), []byte("tkt-user\n"), 0600); err != nil {
+		t.Fatalf("could not write ccache collection primary: %v", err)
+	}
+	kinit(filepath.Join(collection, "tkt-user"))
+	ci, err = NewKRBClientInterceptorFromCCache("DIR:"+collection, cfg)
+	if err != nil {
+		t.Fatalf("could not create client interceptor from DIR ccache: %v", err)
+	}
+	if err := call(ci); err != nil {
+		t.Errorf("call with TGT from DIR ccache failed: %v", err)
+	}
+	ci.Close()
+
+	// once the TGT expires calls fail until kinit is run again
+	testKDC.TicketLifetime = 2 * time.Second
+	kinit(path)
+	testKDC.TicketLifetime = 0
+	ci, err = NewKRBClientInterceptorFromCCache(path, cfg)
+	if err != nil {
+		t.Fatalf("could not create client interceptor: %v", err)
+	}
+	defer ci.Close()
+	if err := call(ci); err != nil {
+		t.Errorf("call with TGT from ccache failed: %v", err)
+	}
+	time.Sleep(3 * time.Second)
+	err = call(ci)
+	if ErrorReason(err) != ReasonCredentialsExpired || !strings.Contains(err.Error(), "kinit") {
+		t.Errorf("expected error for an expired TGT, got: %v", err)
+	}
+	kinit(path)
+	if err := call(ci); err != nil {
+		t.Errorf("call after renewing the ccache failed: %v", err)
+	}
+
+	if _, err := NewKRBClientInterceptorFromCCache("KEYRING:persistent:1000", cfg); err == nil {
+		t.Error("expected an error for an unsupported ccache type")
+	}
+	if _, err := NewKRBClientInterceptorFromCCache(filepath.Join(dir, "missing"), cfg); ErrorReason(err) != ReasonCredentialsExpired {
+		t.Errorf("expected error for a missing ccache, got: %v", err)
+	}
+}
@@ -2,12 +2,17 @@ package grpc_krb
 
 import (
 	"context"
-	"encoding/base64"
-	"net"
-	"strings"
+	"errors"
+	"io"
+	"sync"
+	"time"
 
 	"github.com/jcmturner/gokrb5/v8/client"
 	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/chksumtype"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
 	"github.com/jcmturner/gokrb5/v8/messages"
 	"github.com/jcmturner/gokrb5/v8/types"
 	"google.golang.org/grpc"
@@ -17,89 +22,492 @@ import (
 )
 
 type KRBClientInterceptor struct {
-	KRBClient  *client.Client
+	KRBClient *client.Client
+	// Clients are named clients, one of which can be selected to authenticate a call with the WithClient call option
+	// or ContextWithClient. Calls that do not select one use KRBClient. Each client has its own cache of tickets.
+	Clients    map[string]*client.Client
 	DefaultSPN string
 	MethodSPNs map[string]string
+	// SPNRules map calls to SPNs by pattern. They are evaluated in order after MethodSPNs and before DefaultSPN.
+	SPNRules []SPNRule
+	// FallbackSPNs are tried in order after the SPN for a call if the KDC does not know it or the server rejects the token
+	// with the WRONG_SPN reason. Unary calls rejected by the server are retried. The SPN that worked is remembered per target.
+	// They may use the same placeholders as SPNRules.
+	FallbackSPNs []string
+	// MutualAuth requests that the server proves its identity by returning an AP_REP for every call.
+	// MutualAuthMethods overrides this per full method name.
+	MutualAuth        bool
+	MutualAuthMethods map[string]bool
+	// TokenFormat defines how the token is encoded. Use TokenFormatSPNEGO for servers expecting HTTP Negotiate style tokens
+	// or TokenFormatGSSAPI for servers expecting the initial context token produced by gss_init_sec_context.
+	TokenFormat TokenFormat
+	// OnTokenError defines what happens to a call when a token cannot be attached to it. By default the call fails.
+	OnTokenError TokenErrorPolicy
+	// KDCTimeout limits how long a call waits for tickets to be obtained from the KDC, within the call's own deadline.
+	// Zero means the call's deadline alone applies.
+	KDCTimeout time.Duration
+	// DNSCanonicalization sets how the host in the target is canonicalized using DNS when deriving the SPN.
+	// Lookups are performed with Resolver, or net.DefaultResolver if this is nil.
+	DNSCanonicalization DNSCanonicalization
+	Resolver            Resolver
+	// PerAddressSPN derives the host in the SPN from the backend the balancer picks for each call rather than from the target,
+	// so that each backend of a load balanced connection gets tickets for its own SPN.
+	// The connection must be dialled with AddressCredentials. The token is attached with a grpc.PerRPCCredentials call option
+	// which replaces any other set for the call.
+	PerAddressSPN bool
+	// ConstrainedDelegation authenticates calls as the caller of the server handling the request rather than as the client.
+	// The call's context must be that of a call authenticated by a KRBServerInterceptor. The client obtains a ticket
+	// for the caller with S4U2Proxy, presenting the caller's ticket as evidence, so it must be allowed to delegate to the SPN.
+	ConstrainedDelegation bool
+	// ForwardTGT sends a forwarded copy of the client's TGT with each call, so that the server can make onward calls as the client.
+	// ForwardTGTMethods overrides this per full method name. The client's TGT must be forwardable. Only forward TGTs to
+	// services trusted with the client's full identity. It does not apply to calls made with ConstrainedDelegation.
+	ForwardTGT        bool
+	ForwardTGTMethods map[string]bool
+	// Impersonation allows calls to be authenticated as a user named with ContextWithImpersonation or the Impersonate call option,
+	// who need not have authenticated to the KDC. The client obtains a ticket to itself for the user with S4U2Self and then
+	// one to the SPN with S4U2Proxy, so it must be trusted for protocol transition and allowed to delegate to the SPN.
+	// It takes precedence over ConstrainedDelegation.
+	Impersonation bool
+
+	tcOnce sync.Once
+	tc     *ticketCache
+	tcMux  sync.Mutex
+	tcs    map[string]*ticketCache
+	closed bool
+	canon  canonicalNames
+	spns   spnChoices
+	// ccache is set when the TGT is read from a credential cache rather than obtained by logging in
+	ccache *ccacheSource
+}
+
+// TokenErrorPolicy defines what the client interceptor does when a token cannot be attached to a call.
+type TokenErrorPolicy int
+
+const (
+	// TokenErrorFail fails the call without contacting the server.
+	TokenErrorFail TokenErrorPolicy = iota
+	// TokenErrorProceedUnauthenticated sends the call to the server without a token.
+	TokenErrorProceedUnauthenticated
+	// TokenErrorRetryAfterRelogin logs in to the KDC again and retries attaching a token once before failing the call.
+	TokenErrorRetryAfterRelogin
+)
+
+// methodBindingCksumType is an unassigned checksum type used to carry the GRPC method being called in the authenticator.
+const methodBindingCksumType = 32772
+
+// krbToken holds the client side state of the AP exchange for a single call.
+type krbToken struct {
+	sessionKey types.EncryptionKey
+	auth       types.Authenticator
+	mutual     bool
+	format     TokenFormat
+	spn        spnChoice
+	// value is the encoded token sent in the request metadata
+	value string
 }
 
 func (i *KRBClientInterceptor) Unary() grpc.UnaryClientInterceptor {
 	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
-		ctx, err := i.attachKrbToken(ctx, cc, method)
-		if err != nil {
-			return status.Error(codes.Unknown, err.Error())
+		ctx = withCallImpersonation(withCallClient(ctx, opts), opts)
+		if i.PerAddressSPN {
+			return i.invokePicked(ctx, method, req, reply, cc, invoker, opts...)
+		}
+		for attempt := 1; ; attempt++ {
+			tkn, err := i.token(ctx, cc.Target(), method, i.mutualAuth(method), nil)
+			if err != nil {
+				return err
+			}
+			if tkn == nil {
+				return invoker(ctx, method, req, reply, cc, opts...)
+			}
+			err = tkn.invoke(ctx, method, req, reply, cc, invoker, opts...)
+			if i.retryWithNextSPN(err, tkn, attempt) {
+				continue
+			}
+			return err
 		}
+	}
+}
+
+// invoke invokes a unary call with the token, verifying the server's AP_REP if mutual authentication was requested.
+func (t *krbToken) invoke(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	ctx = metadata.AppendToOutgoingContext(ctx, MDField, t.value)
+	if !t.mutual {
 		return invoker(ctx, method, req, reply, cc, opts...)
 	}
+	var header metadata.MD
+	err := invoker(ctx, method, req, reply, cc, append(opts, grpc.Header(&header))...)
+	if err != nil {
+		return err
+	}
+	return t.verifyAPRep(header)
+}
+
+// retryWithNextSPN reports whether a call the server rejected for the SPN of its token is to be retried with the next candidate SPN.
+func (i *KRBClientInterceptor) retryWithNextSPN(err error, tkn *krbToken, attempt int) bool {
+	return ErrorReason(err) == ReasonWrongSPN && attempt < len(tkn.spn.spns) && i.nextSPN(&tkn.spn)
 }
 
 func (i *KRBClientInterceptor) Stream() grpc.StreamClientInterceptor {
 	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
-		ctx, err := i.attachKrbToken(ctx, cc, method)
-		if err != nil {
-			cs, e := streamer(ctx, desc, cc, method, opts...)
-			if e != nil {
-				return cs, status.Errorf(codes.Unknown, "streamer error: %v attach krb token error: %v", e, err)
+		ctx = withCallImpersonation(withCallClient(ctx, opts), opts)
+		var tkn *krbToken
+		var cs grpc.ClientStream
+		var err error
+		if i.PerAddressSPN {
+			// the stream is created with the token once the balancer has picked the connection
+			pc := &pickedCredentials{i: i, mutual: i.mutualAuth(method)}
+			cs, err = streamer(ctx, desc, cc, method, append(opts, grpc.PerRPCCredentials(pc))...)
+			var terr error
+			tkn, terr = pc.result()
+			if terr != nil {
+				return nil, terr
 			}
-			return cs, status.Error(codes.Unknown, err.Error())
+		} else {
+			tkn, err = i.token(ctx, cc.Target(), method, i.mutualAuth(method), nil)
+			if err != nil {
+				// never open a stream to the server without the token
+				return nil, err
+			}
+			if tkn != nil {
+				ctx = metadata.AppendToOutgoingContext(ctx, MDField, tkn.value)
+			}
+			cs, err = streamer(ctx, desc, cc, method, opts...)
+		}
+		if err != nil || tkn == nil {
+			return cs, err
+		}
+		if tkn.mutual {
+			cs = &mutualAuthClientStream{ClientStream: cs, tkn: tkn}
+		}
+		if len(tkn.spn.spns) > 1 {
+			cs = &spnFallbackClientStream{ClientStream: cs, i: i, tkn: tkn}
+		}
+		return cs, nil
+	}
+}
+
+// invokePicked invokes a unary call with the token created once the balancer has picked the connection.
+func (i *KRBClientInterceptor) invokePicked(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	for attempt := 1; ; attempt++ {
+		pc := &pickedCredentials{i: i, mutual: i.mutualAuth(method)}
+		var header metadata.MD
+		err := invoker(ctx, method, req, reply, cc, append(opts, grpc.PerRPCCredentials(pc), grpc.Header(&header))...)
+		tkn, terr := pc.result()
+		if terr != nil {
+			// GRPC hides the error from the credentials behind its own
+			return terr
+		}
+		if tkn != nil && i.retryWithNextSPN(err, tkn, attempt) {
+			continue
+		}
+		if err != nil || tkn == nil || !tkn.mutual {
+			return err
+		}
+		return tkn.verifyAPRep(header)
+	}
+}
+
+// spnFallbackClientStream moves on to the next candidate SPN for later calls if the server rejects the stream's token
+// for its SPN. The stream itself cannot be retried.
+type spnFallbackClientStream struct {
+	grpc.ClientStream
+	i    *KRBClientInterceptor
+	tkn  *krbToken
+	once sync.Once
+}
+
+func (s *spnFallbackClientStream) check(err error) error {
+	if ErrorReason(err) == ReasonWrongSPN {
+		s.once.Do(func() {
+			s.i.nextSPN(&s.tkn.spn)
+		})
+	}
+	return err
+}
+
+func (s *spnFallbackClientStream) Header() (metadata.MD, error) {
+	md, err := s.ClientStream.Header()
+	return md, s.check(err)
+}
+
+func (s *spnFallbackClientStream) RecvMsg(m interface{}) error {
+	return s.check(s.ClientStream.RecvMsg(m))
+}
+
+// mutualAuthClientStream holds back anything received from the server until the AP_REP
+// in the server's response header has been verified.
+type mutualAuthClientStream struct {
+	grpc.ClientStream
+	tkn    *krbToken
+	once   sync.Once
+	header metadata.MD
+	err    error
+}
+
+func (s *mutualAuthClientStream) verify() error {
+	s.once.Do(func() {
+		s.header, s.err = s.ClientStream.Header()
+		if s.err != nil {
+			return
+		}
+		if len(s.header) == 0 {
+			// a server rejecting the call responds with trailers only, so there is no header and its status is received instead.
+			// Nothing is decoded as the stream has already ended.
+			if err := s.ClientStream.RecvMsg(new(struct{})); err != nil && err != io.EOF {
+				s.err = err
+				return
+			}
+		}
+		s.err = s.tkn.verifyAPRep(s.header)
+	})
+	return s.err
+}
+
+func (s *mutualAuthClientStream) Header() (metadata.MD, error) {
+	if err := s.verify(); err != nil {
+		return nil, err
+	}
+	return s.header, nil
+}
+
+func (s *mutualAuthClientStream) RecvMsg(m interface{}) error {
+	if err := s.verify(); err != nil {
+		return err
+	}
+	return s.ClientStream.RecvMsg(m)
+}
+
+// token creates a token for a call to the method on the target applying the OnTokenError policy if this fails.
+// If the connection's AddressAuthInfo is given the SPN is derived from the address connected to rather than the target.
+// A nil krbToken is returned if the call is to proceed without a token.
+func (i *KRBClientInterceptor) token(ctx context.Context, target, method string, mutual bool, addr *AddressAuthInfo) (*krbToken, error) {
+	tc, err := i.callTickets(ctx)
+	if err != nil {
+		// selecting a client that does not exist is a mistake in the caller rather than a failure to obtain a token.
+		// Likewise for a call to be made with delegated credentials without a caller to delegate for.
+		return nil, err
+	}
+	ev, err := i.evidenceTicket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tkn, err := i.newToken(ctx, tc, ev, target, method, mutual, addr)
+	if err == nil {
+		return tkn, nil
+	}
+	if ctx.Err() != nil {
+		// the call has been cancelled or its deadline passed so there is no point proceeding
+		return nil, tokenError(err)
+	}
+	switch i.OnTokenError {
+	case TokenErrorProceedUnauthenticated:
+		return nil, nil
+	case TokenErrorRetryAfterRelogin:
+		tc.reset()
+		tkn, err = i.newToken(ctx, tc, ev, target, method, mutual, addr)
+		if err == nil {
+			return tkn, nil
+		}
+	}
+	return nil, tokenError(err)
+}
+
+// tickets returns the cache of tickets obtained from the KDC, creating it on first use.
+func (i *KRBClientInterceptor) tickets() *ticketCache {
+	i.tcOnce.Do(func() {
+		i.tc = newTicketCache(i.KRBClient)
+		i.tc.ccache = i.ccache
+	})
+	return i.tc
+}
+
+// Close stops the background renewal of the tickets held by the interceptor for all its clients.
+// Calls made after Close still obtain tickets but these are no longer renewed ahead of expiry.
+func (i *KRBClientInterceptor) Close() {
+	i.tickets().close()
+	i.tcMux.Lock()
+	i.closed = true
+	tcs := make([]*ticketCache, 0, len(i.tcs))
+	for _, tc := range i.tcs {
+		tcs = append(tcs, tc)
+	}
+	i.tcMux.Unlock()
+	for _, tc := range tcs {
+		tc.close()
+	}
+}
+
+// getTicket obtains a service ticket within the call's deadline and the KDCTimeout budget.
+// If an evidence ticket is given the ticket is for its client, with self set if the client obtained it with S4U2Self.
+func (i *KRBClientInterceptor) getTicket(ctx context.Context, tc *ticketCache, ev *messages.Ticket, self bool, spn string) (messages.Ticket, types.EncryptionKey, error) {
+	var tkt messages.Ticket
+	var key types.EncryptionKey
+	err := i.withKDCTimeout(ctx, func(kctx context.Context) error {
+		var err error
+		if ev != nil {
+			tkt, key, err = tc.getDelegated(kctx, spn, ev, self)
+		} else {
+			tkt, key, err = tc.get(kctx, spn)
+		}
+		return err
+	})
+	return tkt, key, err
+}
+
+// withKDCTimeout calls f to obtain tickets from the KDC within the call's deadline and the KDCTimeout budget.
+// If f fails once the call has been cancelled or its deadline passed the call's status is returned,
+// and if the budget ran out the KDC is reported unreachable.
+func (i *KRBClientInterceptor) withKDCTimeout(ctx context.Context, f func(kctx context.Context) error) error {
+	kctx := ctx
+	if i.KDCTimeout > 0 {
+		var cancel context.CancelFunc
+		kctx, cancel = context.WithTimeout(ctx, i.KDCTimeout)
+		defer cancel()
+	}
+	err := f(kctx)
+	if err != nil && kctx.Err() != nil {
+		if ctx.Err() != nil {
+			return status.FromContextError(ctx.Err()).Err()
 		}
-		return streamer(ctx, desc, cc, method, opts...)
+		return authError(codes.Unavailable, ReasonKDCUnreachable, "timed out after %v waiting for the KDC", i.KDCTimeout)
 	}
+	return err
 }
 
-func (i *KRBClientInterceptor) attachKrbToken(ctx context.Context, cc *grpc.ClientConn, method string) (context.Context, error) {
-	err := i.KRBClient.AffirmLogin()
+func (i *KRBClientInterceptor) mutualAuth(method string) bool {
+	if m, ok := i.MutualAuthMethods[method]; ok {
+		return m
+	}
+	return i.MutualAuth
+}
+
+// newToken creates the token for a call to the method on the target authenticated by the client of the ticket cache,
+// or by the client of the evidence ticket if one is given. For a call impersonating a user the evidence ticket is obtained here.
+func (i *KRBClientInterceptor) newToken(ctx context.Context, tc *ticketCache, ev *messages.Ticket, target, method string, mutual bool, addr *AddressAuthInfo) (*krbToken, error) {
+	c, err := i.chooseSPN(ctx, target, method, addr)
 	if err != nil {
-		return ctx, err
+		return nil, err
+	}
+	var self bool
+	if ev == nil {
+		ev, err = i.impersonationTicket(ctx, tc)
+		if err != nil {
+			return nil, err
+		}
+		self = ev != nil
+	}
+	tkt, key, err := i.getTicket(ctx, tc, ev, self, c.spn())
+	for err != nil && ErrorReason(tokenError(err)) == ReasonWrongSPN && i.nextSPN(&c) {
+		// the KDC does not know the SPN so try the next candidate
+		tkt, key, err = i.getTicket(ctx, tc, ev, self, c.spn())
 	}
-	spn := i.resolveSPN(cc, method)
-	tkt, key, err := i.KRBClient.GetServiceTicket(spn)
 	if err != nil {
-		return ctx, err
+		return nil, err
 	}
-	auth, err := types.NewAuthenticator(i.KRBClient.Credentials.Realm(), i.KRBClient.Credentials.CName())
+	crealm, cname := tc.cl.Credentials.Realm(), tc.cl.Credentials.CName()
+	if ev != nil {
+		crealm, cname = ev.DecryptedEncPart.CRealm, ev.DecryptedEncPart.CName
+	}
+	auth, err := types.NewAuthenticator(crealm, cname)
 	if err != nil {
-		return ctx, err
+		return nil, err
 	}
 	etype, err := crypto.GetEtype(key.KeyType)
 	if err != nil {
-		return ctx, err
+		return nil, err
 	}
 	err = auth.GenerateSeqNumberAndSubKey(key.KeyType, etype.GetKeyByteSize())
 	if err != nil {
-		return ctx, err
+		return nil, err
 	}
 
-	auth.Cksum = types.Checksum{
-		CksumType: 32772,          // using an unassigned id as this is not used here
-		Checksum:  []byte(method), // putting the method being called in the authenticator checksum. Server side can check this matches that being called.
+	forward := ev == nil && i.forwardTGT(method)
+	if i.TokenFormat == TokenFormatRaw && !forward {
+		auth.Cksum = types.Checksum{
+			CksumType: methodBindingCksumType,
+			Checksum:  []byte(method), // putting the method being called in the authenticator checksum. Server side checks this matches that being called.
+		}
+	} else {
+		// GSS-API framed tokens use the RFC 4121 checksum with the method carried in the channel bindings.
+		// This is also used to carry a forwarded TGT.
+		gssFlags := uint32(gssapi.ContextFlagInteg)
+		if mutual {
+			gssFlags |= gssapi.ContextFlagMutual
+		}
+		cksum := newGSSChecksum(methodChannelBindings(method), gssFlags)
+		if forward {
+			cred, err := i.forwardedTGT(ctx, tc, auth.SubKey)
+			if err != nil {
+				return nil, err
+			}
+			cksum = appendGSSDelegation(cksum, cred)
+		}
+		auth.Cksum = types.Checksum{
+			CksumType: chksumtype.GSSAPI,
+			Checksum:  cksum,
+		}
 	}
 
 	apReq, err := messages.NewAPReq(tkt, key, auth)
 	if err != nil {
-		return ctx, err
+		return nil, err
+	}
+	tkn := &krbToken{
+		sessionKey: key,
+		auth:       auth,
+		mutual:     mutual,
+		format:     i.TokenFormat,
+		spn:        c,
+	}
+	if tkn.mutual {
+		types.SetFlag(&apReq.APOptions, flags.APOptionMutualRequired)
 	}
 	b, err := apReq.Marshal()
 	if err != nil {
-		return ctx, err
+		return nil, err
+	}
+	tkn.value, err = encodeAPReq(b, tkn.format)
+	if err != nil {
+		return nil, err
 	}
+	return tkn, nil
+}
 
-	b64 := base64.StdEncoding.EncodeToString(b)
-	return metadata.AppendToOutgoingContext(ctx, MDField, b64), nil
+// verifyAPRep checks the AP_REP returned by the server was produced from this call's authenticator.
+func (t *krbToken) verifyAPRep(header metadata.MD) error {
+	err := t.checkAPRep(header)
+	if err != nil {
+		return authError(codes.Unauthenticated, ReasonMutualAuthFailed, "mutual authentication of server failed: %v", err)
+	}
+	return nil
 }
 
-func (i *KRBClientInterceptor) resolveSPN(cc *grpc.ClientConn, method string) string {
-	if spn, ok := i.MethodSPNs[method]; ok {
-		return spn
+func (t *krbToken) checkAPRep(header metadata.MD) error {
+	values := header[MDReplyField]
+	if len(values) == 0 {
+		return errors.New("server did not return an AP_REP")
+	}
+	apRep, err := decodeAPRep(values[0], t.format)
+	if err != nil {
+		return err
 	}
-	if i.DefaultSPN != "" {
-		return i.DefaultSPN
+	pb, err := crypto.DecryptEncPart(apRep.EncPart, t.sessionKey, keyusage.AP_REP_ENCPART)
+	if err != nil {
+		return err
 	}
-	host, _, err := net.SplitHostPort(cc.Target())
+	var encPart messages.EncAPRepPart
+	err = encPart.Unmarshal(pb)
 	if err != nil {
-		return ""
+		return err
+	}
+	// ctime is only carried to the second on the wire, cusec holds the rest
+	if !encPart.CTime.Equal(t.auth.CTime.Truncate(time.Second)) || encPart.Cusec != t.auth.Cusec {
+		return errors.New("AP_REP time does not match the authenticator")
+	}
+	if encPart.SequenceNumber != t.auth.SeqNumber {
+		return errors.New("AP_REP sequence number does not match the authenticator")
 	}
-	var spn strings.Builder
-	spn.WriteString("GRPC/")
-	spn.WriteString(host)
-	return spn.String()
+	return nil
 }
@@ -0,0 +1,78 @@
+package grpc_krb
+
+import (
+	"context"
+
+	"github.com/jcmturner/gokrb5/v8/client"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+type clientNameKey struct{}
+
+// ContextWithClient returns a context selecting the client with this name from the Clients of the interceptor
+// to authenticate the calls made with it. This also applies to KRBCredentials.
+func ContextWithClient(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, clientNameKey{}, name)
+}
+
+// WithClient returns a call option selecting the client with this name from the Clients of the interceptor
+// to authenticate the call. It takes precedence over a client selected with ContextWithClient.
+func WithClient(name string) grpc.CallOption {
+	return clientCallOption{name: name}
+}
+
+type clientCallOption struct {
+	grpc.EmptyCallOption
+	name string
+}
+
+// withCallClient returns the call's context selecting the client named in its call options, if any.
+func withCallClient(ctx context.Context, opts []grpc.CallOption) context.Context {
+	for _, o := range opts {
+		if c, ok := o.(clientCallOption); ok {
+			ctx = ContextWithClient(ctx, c.name)
+		}
+	}
+	return ctx
+}
+
+// callClient returns the name and client selected to authenticate a call, which is KRBClient if none is selected.
+func (i *KRBClientInterceptor) callClient(ctx context.Context) (string, *client.Client, error) {
+	name, _ := ctx.Value(clientNameKey{}).(string)
+	if name == "" {
+		return "", i.KRBClient, nil
+	}
+	cl, ok := i.Clients[name]
+	if !ok || cl == nil {
+		return "", nil, authError(codes.Internal, ReasonInternal, "no Kerberos client named %s", name)
+	}
+	return name, cl, nil
+}
+
+// callTickets returns the cache of tickets for the client selected to authenticate a call.
+// Each client has its own cache, created on first use.
+func (i *KRBClientInterceptor) callTickets(ctx context.Context) (*ticketCache, error) {
+	name, cl, err := i.callClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return i.tickets(), nil
+	}
+	i.tcMux.Lock()
+	defer i.tcMux.Unlock()
+	if tc, ok := i.tcs[name]; ok {
+		return tc, nil
+	}
+	if i.tcs == nil {
+		i.tcs = make(map[string]*ticketCache)
+	}
+	tc := newTicketCache(cl)
+	if i.closed {
+		// tickets are not renewed after Close
+		tc.close()
+	}
+	i.tcs[name] = tc
+	return tc, nil
+}
@@ -0,0 +1,64 @@
+package grpc_krb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/grpckrb/test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClients(t *testing.T) {
+	srv, addr, _ := newTestServer(0)
+	if srv == nil {
+		t.Fatal("could not create grpc server")
+	}
+	defer srv.Stop()
+	// only testuser1 is authorised by the test server
+	ci := newClientInterceptor("", "testuser2")
+	cl, err := testKDC.NewClient("testuser1")
+	if err != nil {
+		t.Fatalf("could not create client: %v", err)
+	}
+	ci.Clients = map[string]*client.Client{"tenant-a": cl}
+	defer ci.Close()
+	conn, err := connectWithInterceptor(addr.String(), ci)
+	if err != nil {
+		t.Fatalf("could not create client connection: %v", err)
+	}
+	defer conn.Close()
+	sc := test.NewServiceClient(conn)
+	req := &test.Request{RequestInt: 1}
+
+	if _, err := sc.Reflector(context.Background(), req, WithClient("tenant-a")); err != nil {
+		t.Errorf("call selecting client with call option failed: %v", err)
+	}
+	// the ticket obtained for tenant-a is not used for the default client
+	if _, err := sc.Reflector(context.Background(), req); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected call with the default client to be denied, got: %v", err)
+	}
+	ctx := ContextWithClient(context.Background(), "tenant-a")
+	if _, err := sc.Reflector(ctx, req); err != nil {
+		t.Errorf("call selecting client with context failed: %v", err)
+	}
+	stream, err := sc.Mirror(context.Background(), WithClient("tenant-a"))
+	if err != nil {
+		t.Fatalf("could not create client stream: %v", err)
+	}
+	if err := stream.Send(req); err != nil {
+		t.Errorf("error sending message: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Errorf("stream selecting client with call option failed: %v", err)
+	}
+	stream.CloseSend()
+
+	if _, err := sc.Reflector(context.Background(), req, WithClient("tenant-b")); ErrorReason(err) != ReasonInternal {
+		t.Errorf("expected error selecting an unknown client, got: %v", err)
+	}
+	if ci.tcs["tenant-a"] == nil || ci.tcs["tenant-a"] == ci.tickets() {
+		t.Error("expected a separate ticket cache for the named client")
+	}
+}
@@ -0,0 +1,54 @@
+package grpc_krb
+
+import (
+	"context"
+	"net/url"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+)
+
+// KRBCredentials implements credentials.PerRPCCredentials attaching a Kerberos token to each call.
+// Tokens are created in the same way and with the same configuration as the embedded KRBClientInterceptor,
+// but as the credentials cannot see the server's response mutual authentication is not performed.
+// Use with grpc.WithPerRPCCredentials or per call with grpc.PerRPCCredentials alongside any other interceptors.
+type KRBCredentials struct {
+	*KRBClientInterceptor
+	// AllowInsecure permits the token to be sent over a connection without transport security.
+	// By default GRPC refuses to use the credentials on a plaintext connection.
+	AllowInsecure bool
+}
+
+func (c *KRBCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	ri, ok := credentials.RequestInfoFromContext(ctx)
+	if !ok {
+		return nil, authError(codes.Internal, ReasonInternal, "no GRPC request information in context")
+	}
+	if !c.AllowInsecure && credentials.CheckSecurityLevel(ctx, credentials.IntegrityOnly) != nil {
+		// connections made with AddressCredentials without transport security are reported as secure by GRPC
+		return nil, authError(codes.Unauthenticated, ReasonInternal, "cannot send a Kerberos token on a connection without transport security")
+	}
+	// the uri is the audience of the call in the form https://<authority>/<service>
+	var target string
+	if len(uri) > 0 {
+		if u, err := url.Parse(uri[0]); err == nil {
+			target = u.Host
+		}
+	}
+	var addr *AddressAuthInfo
+	if c.PerAddressSPN {
+		var ok bool
+		if addr, ok = ri.AuthInfo.(*AddressAuthInfo); !ok {
+			return nil, authError(codes.Internal, ReasonInternal, "PerAddressSPN requires the connection to be dialled with AddressCredentials")
+		}
+	}
+	tkn, err := c.token(ctx, target, ri.Method, false, addr)
+	if err != nil || tkn == nil {
+		return nil, err
+	}
+	return map[string]string{MDField: tkn.value}, nil
+}
+
+func (c *KRBCredentials) RequireTransportSecurity() bool {
+	return !c.AllowInsecure
+}
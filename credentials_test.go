@@ -0,0 +1,77 @@
+package grpc_krb
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/jcmturner/grpckrb/test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestKRBCredentials(t *testing.T) {
+	srv, addr, errChan := newTestServer(0)
+	if srv == nil {
+		t.Fatal("could not create grpc server")
+	}
+	creds := &KRBCredentials{
+		KRBClientInterceptor: newClientInterceptor("", "testuser1"),
+		AllowInsecure:        true,
+	}
+	defer creds.Close()
+
+	// credentials for all calls on the connection
+	conn, err := grpc.Dial(addr.String(), grpc.WithInsecure(), grpc.WithDisableRetry(), grpc.WithPerRPCCredentials(creds))
+	if err != nil {
+		t.Fatalf("could not create client connection: %v", err)
+	}
+	_, err = test.NewServiceClient(conn).Reflector(context.Background(), &test.Request{RequestInt: 1})
+	if err != nil {
+		t.Errorf("error in sending message: %v", err)
+	}
+	stream, err := test.NewServiceClient(conn).Mirror(context.Background())
+	if err != nil {
+		t.Fatalf("could not create client stream: %v", err)
+	}
+	stream.CloseSend()
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Errorf("error receiving from stream: %v", err)
+	}
+	conn.Close()
+
+	// credentials for a single call
+	conn, err = grpc.Dial(addr.String(), grpc.WithInsecure(), grpc.WithDisableRetry())
+	if err != nil {
+		t.Fatalf("could not create client connection: %v", err)
+	}
+	client := test.NewServiceClient(conn)
+	_, err = client.Reflector(context.Background(), &test.Request{RequestInt: 1}, grpc.PerRPCCredentials(creds))
+	if err != nil {
+		t.Errorf("error in sending message with per call credentials: %v", err)
+	}
+	_, err = client.Reflector(context.Background(), &test.Request{RequestInt: 1})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("call without credentials should have failed authentication: %v", err)
+	}
+
+	// plaintext is refused unless allowed
+	secure := &KRBCredentials{KRBClientInterceptor: creds.KRBClientInterceptor}
+	_, err = client.Reflector(context.Background(), &test.Request{RequestInt: 1}, grpc.PerRPCCredentials(secure))
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("credentials should have been refused on a plaintext connection: %v", err)
+	}
+	conn.Close()
+	_, err = grpc.Dial(addr.String(), grpc.WithInsecure(), grpc.WithPerRPCCredentials(secure))
+	if err == nil {
+		t.Error("dial with credentials requiring transport security over plaintext should fail")
+	}
+
+	go srv.GracefulStop()
+	for err := range errChan {
+		if err != nil {
+			t.Errorf("error from grpc server: %v", err)
+		}
+	}
+}
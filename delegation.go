@@ -0,0 +1,124 @@
+package grpc_krb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"google.golang.org/grpc/codes"
+)
+
+// kdcOptionCNameInAddlTkt asks for a ticket for the client of the additional ticket rather than the requester, as used by S4U2Proxy.
+const kdcOptionCNameInAddlTkt = 14
+
+// EvidenceTicketFromContext returns the service ticket the caller authenticated to the KRBServerInterceptor with.
+// It is the evidence a KRBClientInterceptor with ConstrainedDelegation set presents to the KDC to call other services as the caller.
+// The decrypted part is cleared so the caller's session key does not leave the interceptors.
+func EvidenceTicketFromContext(ctx context.Context) (messages.Ticket, bool) {
+	ev, ok := evidenceFromContext(ctx)
+	if !ok {
+		return messages.Ticket{}, false
+	}
+	ev.DecryptedEncPart = messages.EncTicketPart{}
+	return ev, true
+}
+
+// evidenceFromContext returns a copy of the evidence ticket including its decrypted part, which S4U2Proxy needs.
+func evidenceFromContext(ctx context.Context) (messages.Ticket, bool) {
+	p, ok := IdentityFromContext(ctx)
+	if !ok || p.evidence == nil {
+		return messages.Ticket{}, false
+	}
+	return *p.evidence, true
+}
+
+// evidenceTicket returns the evidence ticket for a call to be authenticated as the caller of the server handling the request,
+// or nil if the call is authenticated as the client itself or impersonates a user.
+func (i *KRBClientInterceptor) evidenceTicket(ctx context.Context) (*messages.Ticket, error) {
+	if _, ok := impersonatedUser(ctx); ok {
+		if !i.Impersonation {
+			return nil, authError(codes.Internal, ReasonInternal, "impersonation is not enabled for the interceptor")
+		}
+		// the evidence ticket is obtained with S4U2Self when the token is created
+		return nil, nil
+	}
+	if !i.ConstrainedDelegation {
+		return nil, nil
+	}
+	ev, ok := evidenceFromContext(ctx)
+	if !ok {
+		return nil, authError(codes.Unauthenticated, ReasonDelegationFailed,
+			"constrained delegation requires the context of a call authenticated by the KRBServerInterceptor")
+	}
+	if !types.IsFlagSet(&ev.DecryptedEncPart.Flags, flags.Forwardable) {
+		return nil, authError(codes.Unauthenticated, ReasonDelegationFailed,
+			"the ticket of %s cannot be used for delegation as it is not forwardable", evidenceClient(&ev))
+	}
+	return &ev, nil
+}
+
+// evidenceClient returns the client of the evidence ticket in the form name@REALM.
+func evidenceClient(ev *messages.Ticket) string {
+	return ev.DecryptedEncPart.CName.PrincipalNameString() + "@" + ev.DecryptedEncPart.CRealm
+}
+
+// Delegated tickets are cached by the source of the evidence ticket as well as its client, since those obtained from
+// a ticket the client got for the user with S4U2Self mark the user as authenticated by protocol transition
+// and those obtained from the ticket the user authenticated with do not.
+const (
+	s4u2ProxyEvidence = "S4U2Proxy(evidence) "
+	s4u2ProxySelf     = "S4U2Proxy(self) "
+)
+
+// getDelegated returns a service ticket for the SPN for the client of the evidence ticket, obtaining one by S4U2Proxy
+// if there is not a valid ticket cached. Tickets are cached per client and SPN, and by whether the evidence ticket
+// was obtained by the client itself with S4U2Self.
+func (c *ticketCache) getDelegated(ctx context.Context, spn string, ev *messages.Ticket, self bool) (messages.Ticket, types.EncryptionKey, error) {
+	source := s4u2ProxyEvidence
+	if self {
+		source = s4u2ProxySelf
+	}
+	return c.getTicket(ctx, source+spn+" for "+evidenceClient(ev), func() (*cachedTicket, error) {
+		return c.fetchDelegated(spn, ev)
+	})
+}
+
+// fetchDelegated requests a service ticket for the SPN for the client of the evidence ticket from the KDC with S4U2Proxy.
+func (c *ticketCache) fetchDelegated(spn string, ev *messages.Ticket) (*cachedTicket, error) {
+	tgt, err := c.getTGT()
+	if err != nil {
+		return nil, err
+	}
+	princ, realm := types.ParseSPNString(spn)
+	if realm == "" {
+		realm = c.spnRealm(princ)
+	}
+	if realm != c.cl.Credentials.Domain() {
+		return nil, fmt.Errorf("SPN %s is not in the client's realm %s", spn, c.cl.Credentials.Domain())
+	}
+	// only the ticket itself goes to the KDC, not the parts decrypted by the server
+	addl := messages.Ticket{TktVNO: ev.TktVNO, Realm: ev.Realm, SName: ev.SName, EncPart: ev.EncPart}
+	req, err := newTGSReq(c.cl, tgt.tkt, tgt.key, princ, realm, func(body *messages.KDCReqBody) {
+		types.SetFlag(&body.KDCOptions, kdcOptionCNameInAddlTkt)
+		body.AdditionalTickets = []messages.Ticket{addl}
+	})
+	if err != nil {
+		return nil, err
+	}
+	rep, err := tgsExchange(c.cl, req, realm, tgt.key)
+	if err != nil {
+		if msg := err.Error(); strings.Contains(msg, "KDC_ERR_BADOPTION") || strings.Contains(msg, "KDC_ERR_POLICY") {
+			return nil, authError(codes.Unauthenticated, ReasonDelegationFailed,
+				"KDC refused to delegate the credentials of %s to %s: %v", evidenceClient(ev), spn, err)
+		}
+		return nil, err
+	}
+	if !rep.CName.Equal(ev.DecryptedEncPart.CName) || rep.CRealm != ev.DecryptedEncPart.CRealm {
+		return nil, authError(codes.Unauthenticated, ReasonDelegationFailed,
+			"KDC issued a delegated ticket for %s@%s rather than %s", rep.CName.PrincipalNameString(), rep.CRealm, evidenceClient(ev))
+	}
+	return newCachedTicket(rep.Ticket, rep.DecryptedEncPart), nil
+}
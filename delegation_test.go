@@ -0,0 +1,180 @@
+package grpc_krb
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/jcmturner/grpckrb/test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// proxyServer calls the backend named in the request with the context of the call it is handling.
+type proxyServer struct {
+	test.UnimplementedServiceServer
+	backends map[string]test.ServiceClient
+}
+
+func (s *proxyServer) Reflector(ctx context.Context, req *test.Request) (*test.Response, error) {
+	return s.backends[req.RequestStr].Reflector(ctx, req)
+}
+
+func TestEvidenceTicketFromContext(t *testing.T) {
+	tkt := messages.Ticket{Realm: "TEST.GOKRB5"}
+	tkt.DecryptedEncPart.Key = types.EncryptionKey{KeyType: 18, KeyValue: []byte("session key")}
+	ctx := context.WithValue(context.Background(), principalCtxKey{}, &Principal{evidence: &tkt})
+	ev, ok := EvidenceTicketFromContext(ctx)
+	if !ok || ev.Realm != tkt.Realm {
+		t.Fatalf("expected the evidence ticket, got %v", ev)
+	}
+	if ev.DecryptedEncPart.Key.KeyValue != nil {
+		t.Error("evidence ticket exposes the caller's session key")
+	}
+	if ev, _ := evidenceFromContext(ctx); ev.DecryptedEncPart.Key.KeyValue == nil {
+		t.Error("internal evidence ticket is missing the session key needed for S4U2Proxy")
+	}
+}
+
+func TestConstrainedDelegation(t *testing.T) {
+	const middle = "GRPC/middle.test.gokrb5"
+	srv, addr, _ := newTestServer(0)
+	if srv == nil {
+		t.Fatal("could not create grpc server")
+	}
+	defer srv.Stop()
+	other, otherAddr := newSPNTestServer(t, "GRPC/other.test.gokrb5")
+	defer other.Stop()
+	testKDC.AllowDelegation(middle, "HTTP/host.test.gokrb5")
+
+	// the middle tier calls the backends as its callers using its own keytab
+	cl, err := testKDC.NewClient(middle)
+	if err != nil {
+		t.Fatalf("could not create client: %v", err)
+	}
+	ci := &KRBClientInterceptor{KRBClient: cl, DefaultSPN: "HTTP/host.test.gokrb5", ConstrainedDelegation: true}
+	defer ci.Close()
+	backends := make(map[string]test.ServiceClient)
+	for name, a := range map[string]net.Addr{"allowed": addr, "denied": otherAddr} {
+		conn, err := connectWithInterceptor(a.String(), ci)
+		if err != nil {
+			t.Fatalf("could not create client connection: %v", err)
+		}
+		defer conn.Close()
+		backends[name] = test.NewServiceClient(conn)
+	}
+
+	mkt, err := testKDC.AddPrincipal(middle)
+	if err != nil {
+		t.Fatalf("could not add principal: %v", err)
+	}
+	si := &KRBServerInterceptor{Settings: service.NewSettings(mkt, service.Logger(log.New(os.Stdout, "KRB: ", log.LstdFlags)))}
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	msrv := grpc.NewServer(grpc.UnaryInterceptor(si.Unary()))
+	test.RegisterServiceServer(msrv, &proxyServer{backends: backends})
+	go msrv.Serve(lis)
+	defer msrv.Stop()
+
+	call := func(username, backend string) error {
+		uci := newClientInterceptor(middle, username)
+		defer uci.Close()
+		conn, err := connectWithInterceptor(lis.Addr().String(), uci)
+		if err != nil {
+			t.Fatalf("could not create client connection: %v", err)
+		}
+		defer conn.Close()
+		_, err = test.NewServiceClient(conn).Reflector(context.Background(), &test.Request{RequestStr: backend})
+		return err
+	}
+	if err := call("testuser1", "allowed"); err != nil {
+		t.Errorf("delegated call failed: %v", err)
+	}
+	// the backend only authorises testuser1 so sees the middle tier's caller
+	if err := call("testuser2", "allowed"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected delegated call for testuser2 to be denied by the backend, got: %v", err)
+	}
+
+	ci.DefaultSPN = "GRPC/other.test.gokrb5"
+	if err := call("testuser1", "denied"); ErrorReason(err) != ReasonDelegationFailed {
+		t.Errorf("expected delegation to a service not allowed to fail, got: %v", err)
+	}
+	if _, err := backends["allowed"].Reflector(context.Background(), &test.Request{}); ErrorReason(err) != ReasonDelegationFailed {
+		t.Errorf("expected delegation without a caller to fail, got: %v", err)
+	}
+}
+
+func TestConstrainedDelegation_Impersonation(t *testing.T) {
+	const middle = "GRPC/batch.test.gokrb5"
+	const backend = "HTTP/host.test.gokrb5"
+	srv, addr, _ := newTestServer(0)
+	if srv == nil {
+		t.Fatal("could not create grpc server")
+	}
+	defer srv.Stop()
+	testKDC.AllowProtocolTransition(middle)
+	testKDC.AllowDelegation(middle, backend)
+
+	// one interceptor calls the backend both as the middle tier's callers and as users it impersonates
+	cl, err := testKDC.NewClient(middle)
+	if err != nil {
+		t.Fatalf("could not create client: %v", err)
+	}
+	ci := &KRBClientInterceptor{KRBClient: cl, DefaultSPN: backend, ConstrainedDelegation: true, Impersonation: true}
+	defer ci.Close()
+	conn, err := connectWithInterceptor(addr.String(), ci)
+	if err != nil {
+		t.Fatalf("could not create client connection: %v", err)
+	}
+	defer conn.Close()
+	backends := map[string]test.ServiceClient{"allowed": test.NewServiceClient(conn)}
+
+	mkt, err := testKDC.AddPrincipal(middle)
+	if err != nil {
+		t.Fatalf("could not add principal: %v", err)
+	}
+	si := &KRBServerInterceptor{Settings: service.NewSettings(mkt, service.Logger(log.New(os.Stdout, "KRB: ", log.LstdFlags)))}
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	msrv := grpc.NewServer(grpc.UnaryInterceptor(si.Unary()))
+	test.RegisterServiceServer(msrv, &proxyServer{backends: backends})
+	go msrv.Serve(lis)
+	defer msrv.Stop()
+
+	uci := newClientInterceptor(middle, "testuser1")
+	defer uci.Close()
+	uconn, err := connectWithInterceptor(lis.Addr().String(), uci)
+	if err != nil {
+		t.Fatalf("could not create client connection: %v", err)
+	}
+	defer uconn.Close()
+	if _, err := test.NewServiceClient(uconn).Reflector(context.Background(), &test.Request{RequestStr: "allowed"}); err != nil {
+		t.Fatalf("delegated call failed: %v", err)
+	}
+	if _, err := backends["allowed"].Reflector(context.Background(), &test.Request{}, Impersonate("testuser1")); err != nil {
+		t.Fatalf("impersonated call failed: %v", err)
+	}
+
+	// the impersonated call must not reuse the ticket obtained from the user's own ticket, nor the reverse
+	tc := ci.tickets()
+	tc.mux.Lock()
+	defer tc.mux.Unlock()
+	for _, key := range []string{
+		s4u2ProxyEvidence + backend + " for testuser1@TEST.GOKRB5",
+		s4u2ProxySelf + backend + " for testuser1@TEST.GOKRB5",
+	} {
+		if _, ok := tc.tickets[key]; !ok {
+			t.Errorf("expected a ticket cached under %q", key)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package grpc_krb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/jcmturner/gokrb5/v8/krberror"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrorDomain is the domain of the errdetails.ErrorInfo attached to errors returned by the interceptors.
+const ErrorDomain = "grpckrb"
+
+// Machine readable reasons given in the errdetails.ErrorInfo attached to errors returned by the interceptors.
+// Errors with the codes.Unavailable status code are transient and may be retried.
+const (
+	ReasonMissingToken           = "MISSING_TOKEN"
+	ReasonInvalidToken           = "INVALID_TOKEN"
+	ReasonMethodBinding          = "METHOD_BINDING"
+	ReasonClockSkew              = "CLOCK_SKEW"
+	ReasonReplay                 = "REPLAY"
+	ReasonWrongSPN               = "WRONG_SPN"
+	ReasonNoSPN                  = "NO_SPN"
+	ReasonTicketExpired          = "TICKET_EXPIRED"
+	ReasonTicketNotYetValid      = "TICKET_NOT_YET_VALID"
+	ReasonBadAddress             = "BAD_ADDRESS"
+	ReasonPermissionDenied       = "PERMISSION_DENIED"
+	ReasonMutualAuthFailed       = "MUTUAL_AUTH_FAILED"
+	ReasonKDCUnreachable         = "KDC_UNREACHABLE"
+	ReasonKDCError               = "KDC_ERROR"
+	ReasonCredentialsRejected    = "CREDENTIALS_REJECTED"
+	ReasonCredentialsExpired     = "CREDENTIALS_EXPIRED"
+	ReasonDelegationFailed       = "DELEGATION_FAILED"
+	ReasonProtocolTransition     = "PROTOCOL_TRANSITION"
+	ReasonUntrustedRealm         = "UNTRUSTED_REALM"
+	ReasonReplayCacheUnavailable = "REPLAY_CACHE_UNAVAILABLE"
+	ReasonKeytabUnavailable      = "KEYTAB_UNAVAILABLE"
+	ReasonInternal               = "INTERNAL"
+)
+
+// authError returns a GRPC status error with an errdetails.ErrorInfo carrying the reason provided.
+func authError(c codes.Code, reason, format string, a ...interface{}) error {
+	st := status.Newf(c, format, a...)
+	ds, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason: reason,
+		Domain: ErrorDomain,
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return ds.Err()
+}
+
+// ErrorReason returns the reason from the errdetails.ErrorInfo attached to an error returned by the interceptors.
+// An empty string is returned if there is no such reason.
+func ErrorReason(err error) string {
+	st, ok := status.FromError(err)
+	if !ok {
+		return ""
+	}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.Domain == ErrorDomain {
+			return info.Reason
+		}
+	}
+	return ""
+}
+
+// replayCacheError indicates the replay cache could not be consulted.
+type replayCacheError struct {
+	err error
+}
+
+func (e replayCacheError) Error() string {
+	return fmt.Sprintf("replay cache unavailable: %v", e.err)
+}
+
+// errKeytabUnavailable indicates there is no keytab to verify tickets with, such as when a KeytabSource has not loaded one.
+var errKeytabUnavailable = errors.New("no keytab available")
+
+// verifyError converts an error verifying an AP_REQ into a GRPC status error.
+func verifyError(err error) error {
+	if errors.Is(err, errKeytabUnavailable) {
+		return authError(codes.Unavailable, ReasonKeytabUnavailable, "could not verify authorization token: %v", err)
+	}
+	var rcErr replayCacheError
+	if errors.As(err, &rcErr) {
+		return authError(codes.Unavailable, ReasonReplayCacheUnavailable, "could not verify authorization token: %v", err)
+	}
+	var krbErr messages.KRBError
+	if errors.As(err, &krbErr) {
+		reason := ReasonInvalidToken
+		switch krbErr.ErrorCode {
+		case errorcode.KRB_AP_ERR_SKEW:
+			reason = ReasonClockSkew
+		case errorcode.KRB_AP_ERR_REPEAT:
+			reason = ReasonReplay
+		case errorcode.KRB_AP_ERR_TKT_EXPIRED:
+			reason = ReasonTicketExpired
+		case errorcode.KRB_AP_ERR_TKT_NYV:
+			reason = ReasonTicketNotYetValid
+		case errorcode.KRB_AP_ERR_BADADDR:
+			reason = ReasonBadAddress
+		case errorcode.KRB_AP_ERR_NOT_US, errorcode.KRB_AP_ERR_BADKEYVER, errorcode.KRB_AP_ERR_NOKEY:
+			reason = ReasonWrongSPN
+		}
+		return authError(codes.Unauthenticated, reason, "error verifying AP_REQ authorization token: %v", err)
+	}
+	if krbRootCause(err) == krberror.DecryptingError {
+		// The ticket could not be decrypted with a key in the keytab so was issued for another principal or key version.
+		return authError(codes.Unauthenticated, ReasonWrongSPN, "error verifying AP_REQ authorization token: %v", err)
+	}
+	return authError(codes.Unauthenticated, ReasonInvalidToken, "error verifying AP_REQ authorization token: %v", err)
+}
+
+// tokenError converts an error obtaining a token on the client side into a GRPC status error.
+func tokenError(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		return status.FromContextError(context.Canceled).Err()
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(context.DeadlineExceeded).Err()
+	}
+	switch krbRootCause(err) {
+	case krberror.NetworkingError:
+		return authError(codes.Unavailable, ReasonKDCUnreachable, "could not reach KDC: %v", err)
+	case krberror.KDCError:
+		msg := err.Error()
+		switch {
+		case strings.Contains(msg, "KDC_ERR_S_PRINCIPAL_UNKNOWN"):
+			return authError(codes.Unauthenticated, ReasonWrongSPN, "service principal not known to KDC: %v", err)
+		case strings.Contains(msg, "KRB_AP_ERR_SKEW"):
+			return authError(codes.Unauthenticated, ReasonClockSkew, "clock skew with KDC too great: %v", err)
+		case strings.Contains(msg, "KDC_ERR_SVC_UNAVAILABLE"):
+			return authError(codes.Unavailable, ReasonKDCUnreachable, "KDC unavailable: %v", err)
+		case strings.Contains(msg, "KDC_ERR_C_PRINCIPAL_UNKNOWN"), strings.Contains(msg, "KDC_ERR_PREAUTH_FAILED"),
+			strings.Contains(msg, "KDC_ERR_CLIENT_REVOKED"), strings.Contains(msg, "KDC_ERR_KEY_EXPIRED"):
+			return authError(codes.Unauthenticated, ReasonCredentialsRejected, "client credentials rejected by KDC: %v", err)
+		}
+		return authError(codes.Unauthenticated, ReasonKDCError, "KDC error: %v", err)
+	}
+	return authError(codes.Unauthenticated, ReasonInternal, "could not create kerberos token: %v", err)
+}
+
+// krbRootCause returns the root cause of a gokrb5 error.
+// Some gokrb5 client errors are wrapped as plain errors so the root cause is also looked for in the error text.
+func krbRootCause(err error) string {
+	var kerr krberror.Krberror
+	if errors.As(err, &kerr) {
+		return kerr.RootCause
+	}
+	msg := err.Error()
+	const prefix = "[Root cause: "
+	n := strings.Index(msg, prefix)
+	if n < 0 {
+		return ""
+	}
+	msg = msg[n+len(prefix):]
+	if n = strings.Index(msg, "]"); n >= 0 {
+		return msg[:n]
+	}
+	return ""
+}
@@ -0,0 +1,265 @@
+package grpc_krb
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana"
+	"github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
+	"github.com/jcmturner/gokrb5/v8/iana/chksumtype"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"google.golang.org/grpc/codes"
+)
+
+// gssDelegationOption is the DlgOpt value of an RFC 4121 authenticator checksum carrying a KRB_CRED.
+const gssDelegationOption = 1
+
+// forwardedTGTCacheKey is the key the forwarded TGT is held under in the ticket cache. It cannot clash with an SPN.
+const forwardedTGTCacheKey = "forwarded TGT"
+
+// ForwardedClientFromContext returns a client for the caller logged in with the TGT it forwarded to the KRBServerInterceptor,
+// which the handler can use to make onward Kerberos calls as the caller. The boolean is false if the caller did not forward
+// its TGT or the method does not accept forwarded TGTs.
+func ForwardedClientFromContext(ctx context.Context) (*client.Client, bool) {
+	p, ok := IdentityFromContext(ctx)
+	if !ok || p.forwarded == nil {
+		return nil, false
+	}
+	return p.forwarded, true
+}
+
+func (i *KRBClientInterceptor) forwardTGT(method string) bool {
+	if f, ok := i.ForwardTGTMethods[method]; ok {
+		return f
+	}
+	return i.ForwardTGT
+}
+
+// forwardedTGT returns the client's TGT encoded as a KRB_CRED encrypted with the key, obtaining a forwarded TGT
+// from the KDC if there is not a valid one cached.
+func (i *KRBClientInterceptor) forwardedTGT(ctx context.Context, tc *ticketCache, key types.EncryptionKey) ([]byte, error) {
+	var t *cachedTicket
+	err := i.withKDCTimeout(ctx, func(kctx context.Context) error {
+		var err error
+		t, err = tc.lookup(kctx, forwardedTGTCacheKey, tc.fetchForwarded)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newKRBCred(t, tc.cl.Credentials.Domain(), tc.cl.Credentials.CName(), key)
+}
+
+// fetchForwarded requests a forwarded TGT from the KDC, which the client's TGT must be forwardable for.
+func (c *ticketCache) fetchForwarded() (*cachedTicket, error) {
+	tgt, err := c.getTGT()
+	if err != nil {
+		return nil, err
+	}
+	if !types.IsFlagSet(&tgt.flags, flags.Forwardable) {
+		return nil, authError(codes.Unauthenticated, ReasonDelegationFailed, "the TGT of %s is not forwardable", c.cl.Credentials.CName().PrincipalNameString())
+	}
+	realm := c.cl.Credentials.Domain()
+	sname := types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt/"+realm)
+	req, err := newTGSReq(c.cl, tgt.tkt, tgt.key, sname, realm, func(body *messages.KDCReqBody) {
+		types.SetFlag(&body.KDCOptions, flags.Forwardable)
+		types.SetFlag(&body.KDCOptions, flags.Forwarded)
+		// a forwarded TGT is used from another host so is not bound to addresses
+		body.Addresses = nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	rep, err := tgsExchange(c.cl, req, realm, tgt.key)
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := rep.Verify(c.cl.Config, req); !ok {
+		return nil, err
+	}
+	return newCachedTicket(rep.Ticket, rep.DecryptedEncPart), nil
+}
+
+// krbCred, encKrbCredPart and krbCredInfo marshal a KRB_CRED. The gokrb5 types for it cannot be marshaled
+// and give the service realm the wrong string type.
+type krbCred struct {
+	PVNO    int                 `asn1:"explicit,tag:0"`
+	MsgType int                 `asn1:"explicit,tag:1"`
+	Tickets asn1.RawValue       `asn1:"explicit,tag:2"`
+	EncPart types.EncryptedData `asn1:"explicit,tag:3"`
+}
+
+type encKrbCredPart struct {
+	TicketInfo []krbCredInfo `asn1:"explicit,tag:0"`
+	Timestamp  time.Time     `asn1:"generalized,optional,explicit,tag:2"`
+	Usec       int           `asn1:"optional,explicit,tag:3"`
+}
+
+type krbCredInfo struct {
+	Key       types.EncryptionKey `asn1:"explicit,tag:0"`
+	PRealm    string              `asn1:"generalstring,optional,explicit,tag:1"`
+	PName     types.PrincipalName `asn1:"optional,explicit,tag:2"`
+	Flags     asn1.BitString      `asn1:"optional,explicit,tag:3"`
+	AuthTime  time.Time           `asn1:"generalized,optional,explicit,tag:4"`
+	StartTime time.Time           `asn1:"generalized,optional,explicit,tag:5"`
+	EndTime   time.Time           `asn1:"generalized,optional,explicit,tag:6"`
+	RenewTill time.Time           `asn1:"generalized,optional,explicit,tag:7"`
+	SRealm    string              `asn1:"generalstring,optional,explicit,tag:8"`
+	SName     types.PrincipalName `asn1:"optional,explicit,tag:9"`
+}
+
+// newKRBCred returns a KRB_CRED holding the ticket for the client with its encrypted part encrypted with the key.
+func newKRBCred(t *cachedTicket, crealm string, cname types.PrincipalName, key types.EncryptionKey) ([]byte, error) {
+	now := time.Now().UTC()
+	part := encKrbCredPart{
+		TicketInfo: []krbCredInfo{{
+			Key:       t.key,
+			PRealm:    crealm,
+			PName:     cname,
+			Flags:     t.flags,
+			AuthTime:  t.authTime,
+			StartTime: t.startTime,
+			EndTime:   t.endTime,
+			RenewTill: t.renewTill,
+			SRealm:    t.tkt.Realm,
+			SName:     t.tkt.SName,
+		}},
+		Timestamp: now.Truncate(time.Second),
+		Usec:      now.Nanosecond() / 1000,
+	}
+	b, err := asn1.Marshal(part)
+	if err != nil {
+		return nil, err
+	}
+	b = asn1tools.AddASNAppTag(b, asnAppTag.EncKrbCredPart)
+	ed, err := crypto.GetEncryptedData(b, key, keyusage.KRB_CRED_ENCPART, 0)
+	if err != nil {
+		return nil, err
+	}
+	tkts, err := messages.MarshalTicketSequence([]messages.Ticket{t.tkt})
+	if err != nil {
+		return nil, err
+	}
+	tkts.Tag = 2
+	b, err = asn1.Marshal(krbCred{
+		PVNO:    iana.PVNO,
+		MsgType: msgtype.KRB_CRED,
+		Tickets: tkts,
+		EncPart: ed,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1tools.AddASNAppTag(b, asnAppTag.KRBCred), nil
+}
+
+// appendGSSDelegation adds the KRB_CRED to an RFC 4121 authenticator checksum, setting the delegation flag.
+func appendGSSDelegation(cksum, cred []byte) []byte {
+	binary.LittleEndian.PutUint32(cksum[20:24], binary.LittleEndian.Uint32(cksum[20:24])|gssapi.ContextFlagDeleg)
+	b := make([]byte, 4, 4+len(cred))
+	binary.LittleEndian.PutUint16(b[0:2], gssDelegationOption)
+	binary.LittleEndian.PutUint16(b[2:4], uint16(len(cred)))
+	return append(append(cksum, b...), cred...)
+}
+
+// parseGSSDelegation returns the KRB_CRED from an RFC 4121 authenticator checksum, or nil if the delegation flag is not set.
+func parseGSSDelegation(cksum []byte) ([]byte, error) {
+	_, gssFlags, err := parseGSSChecksum(cksum)
+	if err != nil {
+		return nil, err
+	}
+	if gssFlags&gssapi.ContextFlagDeleg == 0 {
+		return nil, nil
+	}
+	if len(cksum) < 28 || binary.LittleEndian.Uint16(cksum[24:26]) != gssDelegationOption {
+		return nil, errors.New("delegation flag set without credentials")
+	}
+	n := int(binary.LittleEndian.Uint16(cksum[26:28]))
+	if len(cksum) < 28+n {
+		return nil, errors.New("delegated credentials truncated")
+	}
+	return cksum[28 : 28+n], nil
+}
+
+// forwardedClient returns a client for the caller logged in with the TGT it forwarded in the authenticator, if any.
+// The KRB_CRED is decrypted with the authenticator subkey, or with the ticket session key if there is no subkey.
+func (i *KRBServerInterceptor) forwardedClient(apReq *messages.APReq) (*client.Client, error) {
+	if apReq.Authenticator.Cksum.CksumType != chksumtype.GSSAPI {
+		return nil, nil
+	}
+	b, err := parseGSSDelegation(apReq.Authenticator.Cksum.Checksum)
+	if err != nil || b == nil {
+		return nil, err
+	}
+	var cred messages.KRBCred
+	if err := cred.Unmarshal(b); err != nil {
+		return nil, err
+	}
+	key := apReq.Authenticator.SubKey
+	if key.KeyType == 0 {
+		key = apReq.Ticket.DecryptedEncPart.Key
+	}
+	if err := cred.DecryptEncPart(key); err != nil {
+		return nil, err
+	}
+	if len(cred.Tickets) != 1 || len(cred.DecryptedEncPart.TicketInfo) != 1 {
+		return nil, errors.New("delegated credentials must hold a single TGT")
+	}
+	tkt, info := cred.Tickets[0], cred.DecryptedEncPart.TicketInfo[0]
+	if len(tkt.SName.NameString) != 2 || tkt.SName.NameString[0] != "krbtgt" {
+		return nil, fmt.Errorf("delegated credentials hold a ticket for %s rather than a TGT", tkt.SName.PrincipalNameString())
+	}
+	if !info.PName.Equal(apReq.Authenticator.CName) || info.PRealm != apReq.Authenticator.CRealm {
+		return nil, fmt.Errorf("delegated credentials are for %s@%s rather than the caller", info.PName.PrincipalNameString(), info.PRealm)
+	}
+	tb, err := tkt.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := i.forwardedConfig()
+	if err != nil {
+		return nil, err
+	}
+	cc := new(credentials.CCache)
+	cc.DefaultPrincipal.Realm = info.PRealm
+	cc.DefaultPrincipal.PrincipalName = info.PName
+	c := &credentials.Credential{
+		Key:         info.Key,
+		AuthTime:    info.AuthTime,
+		StartTime:   info.StartTime,
+		EndTime:     info.EndTime,
+		RenewTill:   info.RenewTill,
+		TicketFlags: info.Flags,
+		Ticket:      tb,
+	}
+	c.Client.Realm, c.Client.PrincipalName = info.PRealm, info.PName
+	c.Server.Realm, c.Server.PrincipalName = tkt.Realm, tkt.SName
+	cc.Credentials = append(cc.Credentials, c)
+	return client.NewFromCCache(cc, cfg, client.Logger(i.Settings.Logger()))
+}
+
+// forwardedConfig returns the configuration for clients created from forwarded TGTs, loading it on first use if not set.
+func (i *KRBServerInterceptor) forwardedConfig() (*config.Config, error) {
+	if i.Config != nil {
+		return i.Config, nil
+	}
+	i.cfgOnce.Do(func() {
+		i.cfg, i.cfgErr = loadConfig()
+	})
+	return i.cfg, i.cfgErr
+}
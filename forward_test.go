@@ -0,0 +1,134 @@
+package grpc_krb
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/grpckrb/test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// forwardingServer calls the backend as its caller with the TGT the caller forwarded.
+type forwardingServer struct {
+	test.UnimplementedServiceServer
+	backend string
+}
+
+func (s *forwardingServer) Reflector(ctx context.Context, req *test.Request) (*test.Response, error) {
+	cl, ok := ForwardedClientFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.FailedPrecondition, "no forwarded TGT")
+	}
+	ci := &KRBClientInterceptor{KRBClient: cl, DefaultSPN: "HTTP/host.test.gokrb5"}
+	defer ci.Close()
+	conn, err := connectWithInterceptor(s.backend, ci)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return test.NewServiceClient(conn).Reflector(ctx, req)
+}
+
+func TestForwardTGT(t *testing.T) {
+	const middle = "GRPC/middle.test.gokrb5"
+	srv, addr, _ := newTestServer(0)
+	if srv == nil {
+		t.Fatal("could not create grpc server")
+	}
+	defer srv.Stop()
+
+	mkt, err := testKDC.AddPrincipal(middle)
+	if err != nil {
+		t.Fatalf("could not add principal: %v", err)
+	}
+	cfg, err := testKDC.Config()
+	if err != nil {
+		t.Fatalf("could not load config: %v", err)
+	}
+	newMiddle := func(methods map[string]bool) string {
+		si := &KRBServerInterceptor{
+			Settings:            service.NewSettings(mkt, service.Logger(log.New(os.Stdout, "KRB: ", log.LstdFlags))),
+			ForwardedTGTMethods: methods,
+			Config:              cfg,
+		}
+		lis, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatalf("could not listen: %v", err)
+		}
+		msrv := grpc.NewServer(grpc.UnaryInterceptor(si.Unary()))
+		test.RegisterServiceServer(msrv, &forwardingServer{backend: addr.String()})
+		go msrv.Serve(lis)
+		t.Cleanup(msrv.Stop)
+		return lis.Addr().String()
+	}
+	accepting := newMiddle(map[string]bool{"/Service/Reflector": true})
+	ignoring := newMiddle(nil)
+
+	call := func(addr, username string, forward bool) error {
+		ci := newClientInterceptor(middle, username)
+		ci.ForwardTGT = forward
+		defer ci.Close()
+		_, err := sendUnaryMessageWithInterceptor(addr, ci)
+		return err
+	}
+	if err := call(accepting, "testuser1", true); err != nil {
+		t.Errorf("call with forwarded TGT failed: %v", err)
+	}
+	// the backend only authorises testuser1 so sees the caller who forwarded the TGT
+	if err := call(accepting, "testuser2", true); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected onward call for testuser2 to be denied by the backend, got: %v", err)
+	}
+	if err := call(accepting, "testuser1", false); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected no forwarded client without ForwardTGT, got: %v", err)
+	}
+	if err := call(ignoring, "testuser1", true); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected forwarded TGT to be ignored by a method not accepting it, got: %v", err)
+	}
+
+	// ForwardTGTMethods overrides ForwardTGT per method
+	ci := newClientInterceptor(middle, "testuser1")
+	ci.ForwardTGTMethods = map[string]bool{"/Service/Reflector": true}
+	defer ci.Close()
+	if _, err := sendUnaryMessageWithInterceptor(accepting, ci); err != nil {
+		t.Errorf("call with TGT forwarded for the method failed: %v", err)
+	}
+}
+
+func TestForwardTGT_KDCStalled(t *testing.T) {
+	srv, addr, _ := newTestServer(0)
+	if srv == nil {
+		t.Fatal("could not create grpc server")
+	}
+	defer srv.Stop()
+	ci := newClientInterceptor("", "testuser1")
+	defer ci.Close()
+	conn, err := connectWithInterceptor(addr.String(), ci)
+	if err != nil {
+		t.Fatalf("could not create client connection: %v", err)
+	}
+	defer conn.Close()
+	client := test.NewServiceClient(conn)
+	if _, err := client.Reflector(context.Background(), &test.Request{}); err != nil {
+		t.Fatalf("call to cache the service ticket failed: %v", err)
+	}
+
+	// the service ticket is cached so only obtaining the TGT to forward stalls
+	ci.KRBClient.Config.Realms[0].KDC = []string{newStalledKDC(t)}
+	ci.ForwardTGT = true
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := client.Reflector(ctx, &test.Request{}); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("expected the call to exceed its deadline, got: %v", err)
+	}
+	ci.KDCTimeout = 200 * time.Millisecond
+	if _, err := client.Reflector(context.Background(), &test.Request{}); ErrorReason(err) != ReasonKDCUnreachable {
+		t.Errorf("expected the KDC to be reported unreachable, got: %v", err)
+	}
+}
@@ -3,8 +3,10 @@ module github.com/jcmturner/grpckrb
 go 1.15
 
 require (
+	github.com/jcmturner/gofork v1.0.0
 	github.com/jcmturner/goidentity/v6 v6.0.1
 	github.com/jcmturner/gokrb5/v8 v8.4.2
+	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013
 	google.golang.org/grpc v1.33.2
 	google.golang.org/protobuf v1.25.0
 )
@@ -0,0 +1,72 @@
+package grpc_krb
+
+import (
+	"context"
+	"time"
+
+	"github.com/jcmturner/goidentity/v6"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"google.golang.org/grpc"
+)
+
+// Principal is the authenticated caller of a GRPC method.
+type Principal struct {
+	Name      string
+	Realm     string
+	AuthTime  time.Time
+	EndTime   time.Time
+	GroupSIDs []string
+	Identity  goidentity.Identity
+	// ProtocolTransition is set when a service obtained the ticket for the principal with S4U2Self,
+	// so the principal did not authenticate to the KDC. It relies on the KDC marking this in the PAC as Active Directory does.
+	ProtocolTransition bool
+
+	// evidence is the ticket the caller authenticated with, kept for constrained delegation
+	evidence *messages.Ticket
+	// forwarded is the client for the TGT forwarded by the caller
+	forwarded *client.Client
+}
+
+// String returns the principal in the form name@REALM.
+func (p *Principal) String() string {
+	return p.Name + "@" + p.Realm
+}
+
+type principalCtxKey struct{}
+
+// IdentityFromContext returns the principal authenticated by the KRBServerInterceptor for the call.
+// The boolean is false if the call was not authenticated, such as when anonymous access was allowed.
+func IdentityFromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalCtxKey{}).(*Principal)
+	return p, ok
+}
+
+func newPrincipal(creds *credentials.Credentials, apx *apExchange) *Principal {
+	apReq := apx.apReq
+	p := &Principal{
+		Name:      creds.CName().PrincipalNameString(),
+		Realm:     creds.Domain(),
+		AuthTime:  apReq.Ticket.DecryptedEncPart.AuthTime,
+		EndTime:   apReq.Ticket.DecryptedEncPart.EndTime,
+		Identity:  creds,
+		evidence:  &apReq.Ticket,
+		forwarded: apx.forwarded,
+	}
+	if sids := creds.GetADCredentials().GroupMembershipSIDs; len(sids) > 0 {
+		p.GroupSIDs = sids
+	}
+	p.ProtocolTransition = protocolTransition(creds)
+	return p
+}
+
+// wrappedServerStream overrides the context of a grpc.ServerStream.
+type wrappedServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *wrappedServerStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,203 @@
+package grpc_krb
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/crypto/rfc4757"
+	"github.com/jcmturner/gokrb5/v8/iana/chksumtype"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/iana/patype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// authPackageKerberos is the auth package named in a PA-FOR-USER.
+const authPackageKerberos = "Kerberos"
+
+// serviceAssertedIdentitySID is the SID Active Directory adds to the PAC of tickets obtained with S4U2Self,
+// where a service asserted the user's identity rather than the user authenticating to the KDC.
+const serviceAssertedIdentitySID = "S-1-18-2"
+
+type impersonationKey struct{}
+
+// ContextWithImpersonation returns a context for calls to be authenticated as the user, given as name or name@REALM,
+// rather than as the client. The interceptor must have Impersonation set. The user's realm defaults to the client's.
+func ContextWithImpersonation(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, impersonationKey{}, user)
+}
+
+// Impersonate returns a call option authenticating the call as the user, given as name or name@REALM.
+// It takes precedence over a user set with ContextWithImpersonation.
+func Impersonate(user string) grpc.CallOption {
+	return impersonateCallOption{user: user}
+}
+
+type impersonateCallOption struct {
+	grpc.EmptyCallOption
+	user string
+}
+
+// withCallImpersonation returns the call's context impersonating the user named in its call options, if any.
+func withCallImpersonation(ctx context.Context, opts []grpc.CallOption) context.Context {
+	for _, o := range opts {
+		if c, ok := o.(impersonateCallOption); ok {
+			ctx = ContextWithImpersonation(ctx, c.user)
+		}
+	}
+	return ctx
+}
+
+func impersonatedUser(ctx context.Context) (string, bool) {
+	user, _ := ctx.Value(impersonationKey{}).(string)
+	return user, user != ""
+}
+
+// impersonationTicket returns the evidence ticket for a call impersonating a user, obtaining a ticket to the client itself
+// for the user with S4U2Self if there is not a valid one cached. Nil is returned if the call does not impersonate a user.
+func (i *KRBClientInterceptor) impersonationTicket(ctx context.Context, tc *ticketCache) (*messages.Ticket, error) {
+	user, ok := impersonatedUser(ctx)
+	if !ok {
+		return nil, nil
+	}
+	cname, realm := parseUser(user, tc.cl.Credentials.Domain())
+	var t *cachedTicket
+	err := i.withKDCTimeout(ctx, func(kctx context.Context) error {
+		var err error
+		t, err = tc.lookup(kctx, "S4U2Self for "+cname.PrincipalNameString()+"@"+realm, func() (*cachedTicket, error) {
+			return tc.fetchS4U2Self(cname, realm)
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the ticket is encrypted for the client itself, so the parts S4U2Proxy and the authenticator need are taken from the reply
+	ev := t.tkt
+	ev.DecryptedEncPart = messages.EncTicketPart{
+		Flags:     t.flags,
+		Key:       t.key,
+		CRealm:    realm,
+		CName:     cname,
+		AuthTime:  t.authTime,
+		StartTime: t.startTime,
+		EndTime:   t.endTime,
+		RenewTill: t.renewTill,
+	}
+	return &ev, nil
+}
+
+// parseUser splits a user given as name or name@REALM, defaulting the realm.
+func parseUser(user, defaultRealm string) (types.PrincipalName, string) {
+	realm := defaultRealm
+	if n := strings.LastIndex(user, "@"); n >= 0 {
+		user, realm = user[:n], user[n+1:]
+	}
+	return types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, user), realm
+}
+
+// fetchS4U2Self requests a ticket to the client itself for the user from the KDC with S4U2Self.
+// The ticket is only forwardable, and so usable for S4U2Proxy, if the KDC trusts the client to authenticate users for delegation.
+func (c *ticketCache) fetchS4U2Self(cname types.PrincipalName, realm string) (*cachedTicket, error) {
+	tgt, err := c.getTGT()
+	if err != nil {
+		return nil, err
+	}
+	user := cname.PrincipalNameString() + "@" + realm
+	if realm != c.cl.Credentials.Domain() {
+		return nil, fmt.Errorf("cannot impersonate %s as they are not in the client's realm %s", user, c.cl.Credentials.Domain())
+	}
+	pa, err := newPAForUser(cname, realm, tgt.key)
+	if err != nil {
+		return nil, err
+	}
+	req, err := newTGSReq(c.cl, tgt.tkt, tgt.key, c.cl.Credentials.CName(), realm, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.PAData = append(req.PAData, pa)
+	rep, err := tgsExchange(c.cl, req, realm, tgt.key)
+	if err != nil {
+		if msg := err.Error(); strings.Contains(msg, "KDC_ERR_BADOPTION") || strings.Contains(msg, "KDC_ERR_POLICY") ||
+			strings.Contains(msg, "KDC_ERR_C_PRINCIPAL_UNKNOWN") {
+			return nil, authError(codes.Unauthenticated, ReasonDelegationFailed, "KDC refused to issue a ticket for %s: %v", user, err)
+		}
+		return nil, err
+	}
+	if !rep.CName.Equal(cname) || rep.CRealm != realm {
+		return nil, authError(codes.Unauthenticated, ReasonDelegationFailed,
+			"KDC issued a ticket for %s@%s rather than %s", rep.CName.PrincipalNameString(), rep.CRealm, user)
+	}
+	return newCachedTicket(rep.Ticket, rep.DecryptedEncPart), nil
+}
+
+// paForUser is the PA-FOR-USER padata naming the user a service requests a ticket for with S4U2Self.
+type paForUser struct {
+	UserName    types.PrincipalName `asn1:"explicit,tag:0"`
+	UserRealm   string              `asn1:"generalstring,explicit,tag:1"`
+	Cksum       types.Checksum      `asn1:"explicit,tag:2"`
+	AuthPackage string              `asn1:"generalstring,explicit,tag:3"`
+}
+
+// newPAForUser returns the PA-FOR-USER for the user, with its checksum keyed with the TGT session key.
+func newPAForUser(cname types.PrincipalName, realm string, key types.EncryptionKey) (types.PAData, error) {
+	pa := paForUser{UserName: cname, UserRealm: realm, AuthPackage: authPackageKerberos}
+	// the checksum is over the name type as a little endian 32 bit integer, the name components, realm and auth package
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(cname.NameType))
+	for _, n := range cname.NameString {
+		b = append(b, n...)
+	}
+	b = append(append(b, realm...), pa.AuthPackage...)
+	cksum, err := rfc4757.Checksum(key.KeyValue, keyusage.KERB_NON_KERB_CKSUM_SALT, b)
+	if err != nil {
+		return types.PAData{}, err
+	}
+	pa.Cksum = types.Checksum{CksumType: chksumtype.KERB_CHECKSUM_HMAC_MD5, Checksum: cksum}
+	v, err := asn1.Marshal(pa)
+	if err != nil {
+		return types.PAData{}, err
+	}
+	return types.PAData{PADataType: patype.PA_FOR_USER, PADataValue: v}, nil
+}
+
+// protocolTransition reports whether the credentials are for a ticket a service obtained for the user with S4U2Self,
+// as marked in the PAC by Active Directory.
+func protocolTransition(creds *credentials.Credentials) bool {
+	for _, sid := range creds.GetADCredentials().GroupMembershipSIDs {
+		if sid == serviceAssertedIdentitySID {
+			return true
+		}
+	}
+	return false
+}
+
+// verifiedPAC reports whether the credentials carry a PAC verified with the service key.
+func verifiedPAC(creds *credentials.Credentials) bool {
+	_, ok := creds.Attributes()[credentials.AttributeKeyADCredentials]
+	return ok
+}
+
+// checkProtocolTransition refuses callers of methods in DenyProtocolTransitionMethods that authenticated by protocol transition,
+// or that cannot be shown not to have as their ticket has no verified PAC.
+func (i *KRBServerInterceptor) checkProtocolTransition(creds *credentials.Credentials, method string) error {
+	if !i.DenyProtocolTransitionMethods[method] {
+		return nil
+	}
+	if !verifiedPAC(creds) {
+		i.Settings.Logger().Printf("user %s without a PAC refused for request to %s", creds.UserName(), method)
+		return authError(codes.PermissionDenied, ReasonProtocolTransition, "call requires a PAC showing the user was not authenticated by protocol transition")
+	}
+	if protocolTransition(creds) {
+		i.Settings.Logger().Printf("user %s authenticated by protocol transition refused for request to %s", creds.UserName(), method)
+		return authError(codes.PermissionDenied, ReasonProtocolTransition, "call does not accept users authenticated by protocol transition")
+	}
+	return nil
+}
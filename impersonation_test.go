@@ -0,0 +1,125 @@
+package grpc_krb
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/grpckrb/test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestImpersonation(t *testing.T) {
+	const batch = "GRPC/batch.test.gokrb5"
+	const untrusted = "GRPC/untrusted.test.gokrb5"
+	srv, addr, _ := newTestServer(0)
+	if srv == nil {
+		t.Fatal("could not create grpc server")
+	}
+	defer srv.Stop()
+	testKDC.AllowProtocolTransition(batch)
+	testKDC.AllowDelegation(batch, "HTTP/host.test.gokrb5")
+	testKDC.AllowDelegation(untrusted, "HTTP/host.test.gokrb5")
+
+	call := func(service string, impersonation bool, ctx context.Context, user string) error {
+		ci := newClientInterceptor("", service)
+		ci.Impersonation = impersonation
+		defer ci.Close()
+		conn, err := connectWithInterceptor(addr.String(), ci)
+		if err != nil {
+			t.Fatalf("could not create client connection: %v", err)
+		}
+		defer conn.Close()
+		var opts []grpc.CallOption
+		if user != "" {
+			opts = append(opts, Impersonate(user))
+		}
+		_, err = test.NewServiceClient(conn).Reflector(ctx, &test.Request{}, opts...)
+		return err
+	}
+	if err := call(batch, true, ContextWithImpersonation(context.Background(), "testuser1"), ""); err != nil {
+		t.Errorf("impersonated call failed: %v", err)
+	}
+	// the backend only authorises testuser1 so sees the impersonated user, with the call option taking precedence
+	if err := call(batch, true, ContextWithImpersonation(context.Background(), "testuser1"), "testuser2@TEST.GOKRB5"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected impersonated call for testuser2 to be denied by the backend, got: %v", err)
+	}
+	if err := call(batch, true, context.Background(), "nosuchuser"); ErrorReason(err) != ReasonDelegationFailed {
+		t.Errorf("expected impersonating an unknown user to fail, got: %v", err)
+	}
+	if err := call(batch, false, context.Background(), "testuser1"); status.Code(err) != codes.Internal {
+		t.Errorf("expected impersonation without it enabled to fail, got: %v", err)
+	}
+	// a service not trusted for protocol transition gets a ticket for the user that cannot be used for S4U2Proxy
+	if err := call(untrusted, true, context.Background(), "testuser1"); ErrorReason(err) != ReasonDelegationFailed {
+		t.Errorf("expected impersonation by an untrusted service to fail, got: %v", err)
+	}
+}
+
+func TestProtocolTransition(t *testing.T) {
+	creds := credentials.New("testuser1", "TEST.GOKRB5")
+	apx := &apExchange{apReq: new(messages.APReq)}
+	if p := newPrincipal(creds, apx); p.ProtocolTransition {
+		t.Error("principal without a PAC should not be marked as authenticated by protocol transition")
+	}
+	creds.SetADCredentials(credentials.ADCredentials{GroupMembershipSIDs: []string{"S-1-5-21-1-2-3-513", serviceAssertedIdentitySID}})
+	if p := newPrincipal(creds, apx); !p.ProtocolTransition {
+		t.Error("principal with the service asserted identity SID should be marked as authenticated by protocol transition")
+	}
+	si := &KRBServerInterceptor{
+		Settings:                      service.NewSettings(nil, service.Logger(log.New(os.Stdout, "KRB: ", log.LstdFlags))),
+		DenyProtocolTransitionMethods: map[string]bool{"/Service/Reflector": true},
+	}
+	if err := si.checkProtocolTransition(creds, "/Service/Mirror"); err != nil {
+		t.Errorf("method not denying protocol transition refused the caller: %v", err)
+	}
+	if err := si.checkProtocolTransition(creds, "/Service/Reflector"); ErrorReason(err) != ReasonProtocolTransition {
+		t.Errorf("expected caller authenticated by protocol transition to be refused, got: %v", err)
+	}
+	creds.SetADCredentials(credentials.ADCredentials{GroupMembershipSIDs: []string{"S-1-5-21-1-2-3-513"}})
+	if err := si.checkProtocolTransition(creds, "/Service/Reflector"); err != nil {
+		t.Errorf("caller with a PAC not marked for protocol transition was refused: %v", err)
+	}
+	if err := si.checkProtocolTransition(credentials.New("testuser1", "TEST.GOKRB5"), "/Service/Reflector"); ErrorReason(err) != ReasonProtocolTransition {
+		t.Errorf("expected caller without a PAC to be refused, got: %v", err)
+	}
+}
+
+func TestDenyProtocolTransition(t *testing.T) {
+	const batch = "GRPC/batch.test.gokrb5"
+	testKDC.AllowProtocolTransition(batch)
+	testKDC.AllowDelegation(batch, "HTTP/host.test.gokrb5")
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	si := &KRBServerInterceptor{
+		Settings:                      service.NewSettings(testKDC.Keytab("HTTP/host.test.gokrb5"), service.Logger(log.New(os.Stdout, "KRB: ", log.LstdFlags))),
+		DenyProtocolTransitionMethods: map[string]bool{"/Service/Reflector": true},
+	}
+	srv := grpc.NewServer(grpc.UnaryInterceptor(si.Unary()))
+	test.RegisterServiceServer(srv, new(test.Server))
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	ci := newClientInterceptor("", batch)
+	ci.Impersonation = true
+	defer ci.Close()
+	conn, err := connectWithInterceptor(lis.Addr().String(), ci)
+	if err != nil {
+		t.Fatalf("could not create client connection: %v", err)
+	}
+	defer conn.Close()
+	// the test KDC issues no PAC so the impersonated caller cannot be shown to have authenticated to the KDC
+	_, err = test.NewServiceClient(conn).Reflector(context.Background(), &test.Request{}, Impersonate("testuser1"))
+	if status.Code(err) != codes.PermissionDenied || ErrorReason(err) != ReasonProtocolTransition {
+		t.Errorf("expected impersonated call to be refused with the PROTOCOL_TRANSITION reason, got: %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+package grpc_krb
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/iana"
+	"github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
+	"github.com/jcmturner/gokrb5/v8/iana/patype"
+	"github.com/jcmturner/gokrb5/v8/krberror"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// kdcTimeout limits each attempt to reach a KDC, as gokrb5 does.
+const kdcTimeout = 5 * time.Second
+
+// newTGSReq returns a TGS_REQ from the client for the service in the realm, authenticated with the TGT.
+// The body can be altered by edit before the request is authenticated.
+// gokrb5 does not make the TGS exchanges needed for delegation, and its client insists the ticket returned
+// is for its own principal, so these are made with newTGSReq and tgsExchange.
+func newTGSReq(cl *client.Client, tgt messages.Ticket, sessionKey types.EncryptionKey, sname types.PrincipalName, realm string, edit func(*messages.KDCReqBody)) (messages.TGSReq, error) {
+	nonce, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt32))
+	if err != nil {
+		return messages.TGSReq{}, err
+	}
+	cfg := cl.Config
+	req := messages.TGSReq{
+		KDCReqFields: messages.KDCReqFields{
+			PVNO:    iana.PVNO,
+			MsgType: msgtype.KRB_TGS_REQ,
+			ReqBody: messages.KDCReqBody{
+				KDCOptions: types.NewKrbFlags(),
+				Realm:      realm,
+				CName:      cl.Credentials.CName(),
+				SName:      sname,
+				Till:       time.Now().UTC().Add(cfg.LibDefaults.TicketLifetime),
+				Nonce:      int(nonce.Int64()),
+				EType:      cfg.LibDefaults.DefaultTGSEnctypeIDs,
+			},
+		},
+	}
+	if cfg.LibDefaults.Forwardable {
+		types.SetFlag(&req.ReqBody.KDCOptions, flags.Forwardable)
+	}
+	if edit != nil {
+		edit(&req.ReqBody)
+	}
+	b, err := req.ReqBody.Marshal()
+	if err != nil {
+		return req, err
+	}
+	etype, err := crypto.GetEtype(sessionKey.KeyType)
+	if err != nil {
+		return req, err
+	}
+	cksum, err := etype.GetChecksumHash(sessionKey.KeyValue, b, keyusage.TGS_REQ_PA_TGS_REQ_AP_REQ_AUTHENTICATOR_CHKSUM)
+	if err != nil {
+		return req, err
+	}
+	auth, err := types.NewAuthenticator(cl.Credentials.Domain(), cl.Credentials.CName())
+	if err != nil {
+		return req, err
+	}
+	auth.Cksum = types.Checksum{
+		CksumType: etype.GetHashID(),
+		Checksum:  cksum,
+	}
+	apReq, err := messages.NewAPReq(tgt, sessionKey, auth)
+	if err != nil {
+		return req, err
+	}
+	apb, err := apReq.Marshal()
+	if err != nil {
+		return req, err
+	}
+	req.PAData = append(types.PADataSequence{{PADataType: patype.PA_TGS_REQ, PADataValue: apb}}, req.PAData...)
+	return req, nil
+}
+
+// tgsExchange sends the TGS_REQ to a KDC for the realm and returns the reply decrypted with the TGT session key,
+// checking the ticket is for the service requested.
+// Errors are returned as gokrb5 errors so they are reported in the same way as those from the gokrb5 client.
+func tgsExchange(cl *client.Client, req messages.TGSReq, realm string, sessionKey types.EncryptionKey) (messages.TGSRep, error) {
+	rep, err := sendTGSReq(cl, req, realm, sessionKey)
+	if err != nil {
+		return rep, err
+	}
+	if err := checkTGSRepService(req, rep); err != nil {
+		return rep, err
+	}
+	return rep, nil
+}
+
+// checkTGSRepService checks the ticket in the reply is for the service and realm requested.
+// gokrb5's TGSRep.Verify does not check the service, and checks the client is the requester which is not so for S4U2Self and S4U2Proxy.
+func checkTGSRepService(req messages.TGSReq, rep messages.TGSRep) error {
+	body := req.ReqBody
+	if !rep.Ticket.SName.Equal(body.SName) || rep.Ticket.Realm != body.Realm ||
+		!rep.DecryptedEncPart.SName.Equal(body.SName) || rep.DecryptedEncPart.SRealm != body.Realm {
+		return krberror.NewErrorf(krberror.KRBMsgError, "KDC issued a ticket for %s@%s when asked for %s@%s",
+			rep.DecryptedEncPart.SName.PrincipalNameString(), rep.DecryptedEncPart.SRealm, body.SName.PrincipalNameString(), body.Realm)
+	}
+	return nil
+}
+
+// sendTGSReq makes the TGS exchange as tgsExchange does without checking the service of the ticket,
+// for requests a KDC may answer with a referral to another realm.
+func sendTGSReq(cl *client.Client, req messages.TGSReq, realm string, sessionKey types.EncryptionKey) (messages.TGSRep, error) {
+	var rep messages.TGSRep
+	b, err := req.Marshal()
+	if err != nil {
+		return rep, krberror.Errorf(err, krberror.EncodingError, "failed to marshal TGS_REQ")
+	}
+	rb, err := sendToKDC(cl, realm, b)
+	if err != nil {
+		if _, ok := err.(messages.KRBError); ok {
+			return rep, krberror.Errorf(err, krberror.KDCError, "kerberos error response from KDC when requesting for %s", req.ReqBody.SName.PrincipalNameString())
+		}
+		return rep, krberror.Errorf(err, krberror.NetworkingError, "issue sending TGS_REQ to KDC")
+	}
+	if err := rep.Unmarshal(rb); err != nil {
+		return rep, krberror.Errorf(err, krberror.EncodingError, "failed to process the TGS_REP")
+	}
+	if err := rep.DecryptEncPart(sessionKey); err != nil {
+		return rep, krberror.Errorf(err, krberror.EncodingError, "failed to process the TGS_REP")
+	}
+	if rep.DecryptedEncPart.Nonce != req.ReqBody.Nonce {
+		return rep, krberror.NewErrorf(krberror.KRBMsgError, "possible replay attack, nonce in TGS_REP does not match that in request")
+	}
+	return rep, nil
+}
+
+// sendToKDC sends a message over TCP to each KDC configured for the realm in turn until one responds.
+// A KRB_ERROR response is returned as a messages.KRBError.
+func sendToKDC(cl *client.Client, realm string, b []byte) ([]byte, error) {
+	_, kdcs, err := cl.Config.GetKDCs(realm, true)
+	if err != nil {
+		return nil, err
+	}
+	var errs []string
+	for n := 1; n <= len(kdcs); n++ {
+		rb, err := sendTCP(kdcs[n], b)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if len(rb) > 0 && rb[0] == 0x60|asnAppTag.KRBError {
+			var krberr messages.KRBError
+			if err := krberr.Unmarshal(rb); err != nil {
+				return nil, err
+			}
+			return nil, krberr
+		}
+		return rb, nil
+	}
+	return nil, fmt.Errorf("could not reach any KDC for %s: %s", realm, strings.Join(errs, "; "))
+}
+
+// sendTCP exchanges a message with the KDC at the address, framed with a 4 byte length as per RFC 4120 7.2.2.
+func sendTCP(addr string, b []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", addr, kdcTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(kdcTimeout))
+	hb := make([]byte, 4)
+	binary.BigEndian.PutUint32(hb, uint32(len(b)))
+	if _, err := conn.Write(append(hb, b...)); err != nil {
+		return nil, fmt.Errorf("error sending to KDC %s: %v", addr, err)
+	}
+	if _, err := io.ReadFull(conn, hb); err != nil {
+		return nil, fmt.Errorf("error reading from KDC %s: %v", addr, err)
+	}
+	rb := make([]byte, binary.BigEndian.Uint32(hb))
+	if _, err := io.ReadFull(conn, rb); err != nil {
+		return nil, fmt.Errorf("error reading from KDC %s: %v", addr, err)
+	}
+	if len(rb) == 0 {
+		return nil, errors.New("empty response from KDC " + addr)
+	}
+	return rb, nil
+}
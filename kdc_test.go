@@ -0,0 +1,37 @@
+package grpc_krb
+
+import (
+	"testing"
+
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+func TestCheckTGSRepService(t *testing.T) {
+	spn := types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "HTTP/host.test.gokrb5")
+	other := types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "HTTP/other.test.gokrb5")
+	var req messages.TGSReq
+	req.ReqBody.SName, req.ReqBody.Realm = spn, "TEST.GOKRB5"
+	reply := func(tktName types.PrincipalName, tktRealm string, encName types.PrincipalName, encRealm string) messages.TGSRep {
+		var rep messages.TGSRep
+		rep.Ticket.SName, rep.Ticket.Realm = tktName, tktRealm
+		rep.DecryptedEncPart.SName, rep.DecryptedEncPart.SRealm = encName, encRealm
+		return rep
+	}
+	var tests = []struct {
+		name string
+		rep  messages.TGSRep
+		ok   bool
+	}{
+		{"requested service", reply(spn, "TEST.GOKRB5", spn, "TEST.GOKRB5"), true},
+		{"other service", reply(other, "TEST.GOKRB5", other, "TEST.GOKRB5"), false},
+		{"other realm", reply(spn, "OTHER.GOKRB5", spn, "OTHER.GOKRB5"), false},
+		{"ticket and reply disagree", reply(spn, "TEST.GOKRB5", other, "TEST.GOKRB5"), false},
+	}
+	for _, tt := range tests {
+		if err := checkTGSRepService(req, tt.rep); (err == nil) != tt.ok {
+			t.Errorf("%s: unexpected result: %v", tt.name, err)
+		}
+	}
+}
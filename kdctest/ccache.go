@@ -0,0 +1,91 @@
+package kdctest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// CCache issues a TGT to the principal, as kinit would, and returns a credential cache holding it
+// in the version 4 file format used by MIT Kerberos. The principal is added if it does not exist.
+func (k *KDC) CCache(name string) ([]byte, error) {
+	if _, err := k.AddPrincipal(name); err != nil {
+		return nil, err
+	}
+	cname := types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, name)
+	sname := types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt/"+k.Realm)
+	body := messages.KDCReqBody{
+		KDCOptions: types.NewKrbFlags(),
+		CName:      cname,
+		Realm:      k.Realm,
+		SName:      sname,
+		EType:      etypes,
+	}
+	now := time.Now().UTC()
+	tktFlags := types.NewKrbFlags()
+	types.SetFlag(&tktFlags, flags.Initial)
+	tkt, key, err := k.ticket(body, cname, k.Realm, now, now, tktFlags)
+	if err != nil {
+		return nil, err
+	}
+	encPart, err := k.encKDCRepPart(body, tkt, key, now)
+	if err != nil {
+		return nil, err
+	}
+	tb, err := tkt.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	w := func(v interface{}) {
+		binary.Write(&b, binary.BigEndian, v)
+	}
+	data := func(d []byte) {
+		w(uint32(len(d)))
+		b.Write(d)
+	}
+	principal := func(p types.PrincipalName) {
+		w(p.NameType)
+		w(uint32(len(p.NameString)))
+		data([]byte(k.Realm))
+		for _, s := range p.NameString {
+			data([]byte(s))
+		}
+	}
+	timestamp := func(t time.Time) {
+		if t.IsZero() {
+			w(uint32(0))
+			return
+		}
+		w(uint32(t.Unix()))
+	}
+	// version 4 with a header holding a zero KDC time offset
+	w(uint16(0x0504))
+	w(uint16(12))
+	w(uint16(1))
+	w(uint16(8))
+	w(uint64(0))
+	principal(cname)
+	principal(cname)
+	principal(sname)
+	w(uint16(key.KeyType))
+	data(key.KeyValue)
+	timestamp(encPart.AuthTime)
+	timestamp(encPart.StartTime)
+	timestamp(encPart.EndTime)
+	timestamp(encPart.RenewTill)
+	w(uint8(0))
+	b.Write(encPart.Flags.Bytes)
+	// no addresses or authorization data
+	w(uint32(0))
+	w(uint32(0))
+	data(tb)
+	data(nil)
+	return b.Bytes(), nil
+}
@@ -0,0 +1,519 @@
+// Package kdctest provides an in-memory Kerberos KDC for testing.
+//
+// The KDC serves AS and TGS exchanges over TCP on an ephemeral loopback port.
+// Principals are minted on the fly and their keytabs handed to the test, and a
+// matching krb5.conf is rendered so clients can be pointed at the KDC without any
+// external infrastructure.
+package kdctest
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/iana"
+	"github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/iana/patype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// DefaultTicketLifetime is the lifetime of tickets issued when KDC.TicketLifetime is not set.
+const DefaultTicketLifetime = 10 * time.Hour
+
+// etypes are the encryption types keys are minted for, in order of preference.
+var etypes = []int32{etypeID.AES256_CTS_HMAC_SHA1_96, etypeID.AES128_CTS_HMAC_SHA1_96}
+
+// KDC is an in-memory Kerberos key distribution centre for a single realm.
+type KDC struct {
+	Realm string
+	// TicketLifetime caps the lifetime of the tickets issued. Defaults to DefaultTicketLifetime.
+	TicketLifetime time.Duration
+
+	lis      net.Listener
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	db       *keytab.Keytab
+	keytabs  map[string]*keytab.Keytab
+	kvnos    map[string]uint8
+	requests int
+	// delegation holds the services each service may obtain tickets to for its callers
+	delegation map[string][]string
+	// protocolTransition holds the services trusted to obtain forwardable tickets for users with S4U2Self
+	protocolTransition map[string]bool
+	// trusts are the realms the KDC issues cross-realm TGTs for
+	trusts []trust
+}
+
+// New starts a KDC for the realm listening on an ephemeral loopback port.
+// The krbtgt principal for the realm is created. The KDC should be closed once finished with.
+func New(realm string) (*KDC, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	k := &KDC{
+		Realm:      realm,
+		lis:        lis,
+		db:         keytab.New(),
+		keytabs:    make(map[string]*keytab.Keytab),
+		kvnos:      make(map[string]uint8),
+		delegation: make(map[string][]string),
+
+		protocolTransition: make(map[string]bool),
+	}
+	_, err = k.AddPrincipal("krbtgt/" + realm)
+	if err != nil {
+		lis.Close()
+		return nil, err
+	}
+	k.wg.Add(1)
+	go k.serve()
+	return k, nil
+}
+
+// Addr returns the host:port the KDC is listening on.
+func (k *KDC) Addr() string {
+	return k.lis.Addr().String()
+}
+
+// Close stops the KDC and waits for in flight requests to complete.
+func (k *KDC) Close() error {
+	err := k.lis.Close()
+	k.wg.Wait()
+	return err
+}
+
+// Requests returns the number of AS and TGS requests the KDC has received.
+func (k *KDC) Requests() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.requests
+}
+
+// AddPrincipal creates the principal with a random key and returns a keytab holding it.
+// The name is in the form "user" or "service/host" and is created in the KDC's realm.
+// Adding a principal that already exists returns its existing keytab.
+func (k *KDC) AddPrincipal(name string) (*keytab.Keytab, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if kt, ok := k.keytabs[name]; ok {
+		return kt, nil
+	}
+	return k.addKeys(name, 1)
+}
+
+// RotateKey gives the principal a new random key with the next key version number and returns a keytab holding only the new key.
+// Tickets issued from then on are encrypted with the new key while those already issued remain under the previous one.
+func (k *KDC) RotateKey(name string) (*keytab.Keytab, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	kvno, ok := k.kvnos[name]
+	if !ok {
+		return nil, fmt.Errorf("principal %s@%s not found", name, k.Realm)
+	}
+	return k.addKeys(name, kvno+1)
+}
+
+// addKeys mints random keys for the principal at the key version number, making them its current keys.
+func (k *KDC) addKeys(name string, kvno uint8) (*keytab.Keytab, error) {
+	pw := make([]byte, 16)
+	_, err := rand.Read(pw)
+	if err != nil {
+		return nil, err
+	}
+	kt := keytab.New()
+	ts := time.Now()
+	for _, et := range etypes {
+		err = kt.AddEntry(name, k.Realm, hex.EncodeToString(pw), ts, kvno, et)
+		if err != nil {
+			return nil, err
+		}
+	}
+	k.db.Entries = append(k.db.Entries, kt.Entries...)
+	k.keytabs[name] = kt
+	k.kvnos[name] = kvno
+	return kt, nil
+}
+
+// Keytab returns the keytab of a principal previously added or nil if there is no such principal.
+func (k *KDC) Keytab(name string) *keytab.Keytab {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.keytabs[name]
+}
+
+// Krb5Conf renders a krb5.conf pointing clients at the KDC and the KDCs of the realms it trusts, directly or through others.
+// The lower case name of each realm is mapped to the realm as a DNS domain.
+func (k *KDC) Krb5Conf() string {
+	kdcs := k.trusted()
+	var b strings.Builder
+	fmt.Fprintf(&b, `[libdefaults]
+  default_realm = %s
+  dns_lookup_realm = false
+  dns_lookup_kdc = false
+  ticket_lifetime = 24h
+  forwardable = yes
+  udp_preference_limit = 1
+  default_tkt_enctypes = aes256-cts-hmac-sha1-96
+  default_tgs_enctypes = aes256-cts-hmac-sha1-96
+
+[realms]
+`, k.Realm)
+	for _, t := range kdcs {
+		fmt.Fprintf(&b, " %s = {\n  kdc = %s\n  default_domain = %s\n }\n", t.Realm, t.Addr(), strings.ToLower(t.Realm))
+	}
+	b.WriteString("\n[domain_realm]\n")
+	for _, t := range kdcs {
+		domain := strings.ToLower(t.Realm)
+		fmt.Fprintf(&b, " .%s = %s\n %s = %s\n", domain, t.Realm, domain, t.Realm)
+	}
+	return b.String()
+}
+
+// Config returns a newly parsed copy of the configuration rendered by Krb5Conf.
+func (k *KDC) Config() (*config.Config, error) {
+	return config.NewFromString(k.Krb5Conf())
+}
+
+// NewClient returns a client for the principal using its keytab, adding the principal if it does not exist.
+func (k *KDC) NewClient(name string, settings ...func(*client.Settings)) (*client.Client, error) {
+	kt, err := k.AddPrincipal(name)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := k.Config()
+	if err != nil {
+		return nil, err
+	}
+	return client.NewWithKeytab(name, k.Realm, kt, cfg, settings...), nil
+}
+
+func (k *KDC) serve() {
+	defer k.wg.Done()
+	for {
+		conn, err := k.lis.Accept()
+		if err != nil {
+			return
+		}
+		k.wg.Add(1)
+		go func() {
+			defer k.wg.Done()
+			k.handle(conn)
+		}()
+	}
+}
+
+// handle processes a single request on the connection. Messages are framed with a 4 byte length as per RFC 4120 7.2.2.
+func (k *KDC) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	hb := make([]byte, 4)
+	_, err := io.ReadFull(conn, hb)
+	if err != nil {
+		return
+	}
+	b := make([]byte, binary.BigEndian.Uint32(hb))
+	_, err = io.ReadFull(conn, b)
+	if err != nil || len(b) < 1 {
+		return
+	}
+	k.mu.Lock()
+	k.requests++
+	k.mu.Unlock()
+
+	var rb []byte
+	switch b[0] {
+	case 0x60 | asnAppTag.ASREQ:
+		rb, err = k.asExchange(b)
+	case 0x60 | asnAppTag.TGSREQ:
+		rb, err = k.tgsExchange(b)
+	default:
+		err = newKRBError(errorcode.KRB_ERR_GENERIC, types.PrincipalName{}, "unsupported message type")
+	}
+	if err != nil {
+		e, ok := err.(krbError)
+		if !ok {
+			e = newKRBError(errorcode.KRB_ERR_GENERIC, types.PrincipalName{}, err.Error())
+		}
+		e.Realm = k.Realm
+		rb, err = e.Marshal()
+		if err != nil {
+			return
+		}
+	}
+	binary.BigEndian.PutUint32(hb, uint32(len(rb)))
+	conn.Write(append(hb, rb...))
+}
+
+func (k *KDC) asExchange(b []byte) ([]byte, error) {
+	var req messages.ASReq
+	err := req.Unmarshal(b)
+	if err != nil {
+		return nil, newKRBError(errorcode.KRB_ERR_GENERIC, types.PrincipalName{}, err.Error())
+	}
+	body := req.ReqBody
+	et, ok := k.etype(body.EType)
+	if !ok {
+		return nil, newKRBError(errorcode.KDC_ERR_ETYPE_NOSUPP, body.SName, "no supported encryption type requested")
+	}
+	ckey, ckvno, err := k.key(body.CName, et)
+	if err != nil {
+		return nil, newKRBError(errorcode.KDC_ERR_C_PRINCIPAL_UNKNOWN, body.SName, err.Error())
+	}
+	now := time.Now().UTC()
+	tktFlags := types.NewKrbFlags()
+	types.SetFlag(&tktFlags, flags.Initial)
+	tkt, sessionKey, err := k.ticket(body, body.CName, k.Realm, now, now, tktFlags)
+	if err != nil {
+		return nil, err
+	}
+	encPart, err := k.encKDCRepPart(body, tkt, sessionKey, now)
+	if err != nil {
+		return nil, err
+	}
+	pb, err := encPart.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	ed, err := crypto.GetEncryptedData(pb, ckey, keyusage.AS_REP_ENCPART, ckvno)
+	if err != nil {
+		return nil, err
+	}
+	rep := messages.ASRep{
+		KDCRepFields: messages.KDCRepFields{
+			PVNO:    iana.PVNO,
+			MsgType: msgtype.KRB_AS_REP,
+			CRealm:  k.Realm,
+			CName:   body.CName,
+			Ticket:  tkt,
+			EncPart: ed,
+		},
+	}
+	return rep.Marshal()
+}
+
+func (k *KDC) tgsExchange(b []byte) ([]byte, error) {
+	var req messages.TGSReq
+	err := req.Unmarshal(b)
+	if err != nil {
+		return nil, newKRBError(errorcode.KRB_ERR_GENERIC, types.PrincipalName{}, err.Error())
+	}
+	body := req.ReqBody
+	var apReq messages.APReq
+	var forUser []byte
+	for _, pa := range req.PAData {
+		switch pa.PADataType {
+		case patype.PA_TGS_REQ:
+			err = apReq.Unmarshal(pa.PADataValue)
+			if err != nil {
+				return nil, newKRBError(errorcode.KRB_ERR_GENERIC, body.SName, err.Error())
+			}
+		case patype.PA_FOR_USER:
+			forUser = pa.PADataValue
+		}
+	}
+	tgt := apReq.Ticket
+	if len(tgt.SName.NameString) != 2 || tgt.SName.NameString[0] != "krbtgt" {
+		return nil, newKRBError(errorcode.KDC_ERR_POLICY, body.SName, "TGS_REQ does not carry a TGT")
+	}
+	tgtKey, _, err := k.db.GetEncryptionKey(tgt.SName, tgt.Realm, tgt.EncPart.KVNO, tgt.EncPart.EType)
+	if err != nil {
+		return nil, newKRBError(errorcode.KDC_ERR_S_PRINCIPAL_UNKNOWN, body.SName, err.Error())
+	}
+	err = tgt.Decrypt(tgtKey)
+	if err != nil {
+		return nil, newKRBError(errorcode.KRB_AP_ERR_BAD_INTEGRITY, body.SName, err.Error())
+	}
+	tgtPart := tgt.DecryptedEncPart
+	err = apReq.DecryptAuthenticator(tgtPart.Key)
+	if err != nil {
+		return nil, newKRBError(errorcode.KRB_AP_ERR_BAD_INTEGRITY, body.SName, err.Error())
+	}
+	now := time.Now().UTC()
+	if now.After(tgtPart.EndTime) {
+		return nil, newKRBError(errorcode.KRB_AP_ERR_TKT_EXPIRED, body.SName, "TGT has expired")
+	}
+	if _, ok := k.etype(body.EType); !ok {
+		return nil, newKRBError(errorcode.KDC_ERR_ETYPE_NOSUPP, body.SName, "no supported encryption type requested")
+	}
+	if _, _, err := k.key(body.SName, etypes[0]); err != nil {
+		// services in trusted realms are referred to with a TGT for the realm
+		realm, ok := k.referral(body.SName)
+		if !ok {
+			return nil, newKRBError(errorcode.KDC_ERR_S_PRINCIPAL_UNKNOWN, body.SName, err.Error())
+		}
+		body.SName = types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt/"+realm)
+	}
+	if body.Till.IsZero() || body.Till.After(tgtPart.EndTime) {
+		body.Till = tgtPart.EndTime
+	}
+	// the ticket is for the client of the TGT unless it is requested for another by S4U2Self or S4U2Proxy
+	cname, crealm, authTime := tgtPart.CName, tgtPart.CRealm, tgtPart.AuthTime
+	if forUser != nil {
+		cname, crealm, err = k.s4u2Self(forUser, &body, tgtPart)
+		if err != nil {
+			return nil, err
+		}
+		authTime = now
+	} else if types.IsFlagSet(&body.KDCOptions, cnameInAddlTkt) {
+		ev, err := k.s4u2Proxy(body, tgtPart)
+		if err != nil {
+			return nil, err
+		}
+		cname, crealm, authTime = ev.CName, ev.CRealm, ev.AuthTime
+		if body.Till.After(ev.EndTime) {
+			body.Till = ev.EndTime
+		}
+	}
+	tktFlags := types.NewKrbFlags()
+	// a forwarded TGT may only be issued from a forwardable one
+	if types.IsFlagSet(&body.KDCOptions, flags.Forwarded) {
+		if !types.IsFlagSet(&tgtPart.Flags, flags.Forwardable) {
+			return nil, newKRBError(errorcode.KDC_ERR_BADOPTION, body.SName, "TGT is not forwardable")
+		}
+		types.SetFlag(&tktFlags, flags.Forwarded)
+	}
+	tkt, sessionKey, err := k.ticket(body, cname, crealm, authTime, now, tktFlags)
+	if err != nil {
+		return nil, err
+	}
+	encPart, err := k.encKDCRepPart(body, tkt, sessionKey, authTime)
+	if err != nil {
+		return nil, err
+	}
+	pb, err := asn1.Marshal(encPart)
+	if err != nil {
+		return nil, err
+	}
+	pb = asn1tools.AddASNAppTag(pb, asnAppTag.EncTGSRepPart)
+	replyKey, usage := tgtPart.Key, keyusage.TGS_REP_ENCPART_SESSION_KEY
+	if apReq.Authenticator.SubKey.KeyType != 0 {
+		replyKey, usage = apReq.Authenticator.SubKey, keyusage.TGS_REP_ENCPART_AUTHENTICATOR_SUB_KEY
+	}
+	ed, err := crypto.GetEncryptedData(pb, replyKey, uint32(usage), 0)
+	if err != nil {
+		return nil, err
+	}
+	rep := messages.TGSRep{
+		KDCRepFields: messages.KDCRepFields{
+			PVNO:    iana.PVNO,
+			MsgType: msgtype.KRB_TGS_REP,
+			CRealm:  crealm,
+			CName:   cname,
+			Ticket:  tkt,
+			EncPart: ed,
+		},
+	}
+	return rep.Marshal()
+}
+
+// ticket issues a ticket for the client to the requested service encrypted with the service's key.
+func (k *KDC) ticket(body messages.KDCReqBody, cname types.PrincipalName, crealm string, authTime, now time.Time, tktFlags asn1.BitString) (messages.Ticket, types.EncryptionKey, error) {
+	et, _ := k.etype(body.EType)
+	_, kvno, err := k.key(body.SName, et)
+	if err != nil {
+		return messages.Ticket{}, types.EncryptionKey{}, newKRBError(errorcode.KDC_ERR_S_PRINCIPAL_UNKNOWN, body.SName, err.Error())
+	}
+	for _, f := range []int{flags.Forwardable, flags.Proxiable} {
+		if types.IsFlagSet(&body.KDCOptions, f) {
+			types.SetFlag(&tktFlags, f)
+		}
+	}
+	var renewTill time.Time
+	if types.IsFlagSet(&body.KDCOptions, flags.Renewable) && !body.RTime.IsZero() {
+		types.SetFlag(&tktFlags, flags.Renewable)
+		renewTill = body.RTime
+	}
+	k.mu.Lock()
+	lifetime := k.TicketLifetime
+	k.mu.Unlock()
+	if lifetime <= 0 {
+		lifetime = DefaultTicketLifetime
+	}
+	endTime := now.Add(lifetime)
+	if !body.Till.IsZero() && body.Till.Before(endTime) {
+		endTime = body.Till
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return messages.NewTicket(cname, crealm, body.SName, k.Realm, tktFlags, k.db, et, kvno, authTime, now, endTime, renewTill)
+}
+
+func (k *KDC) encKDCRepPart(body messages.KDCReqBody, tkt messages.Ticket, sessionKey types.EncryptionKey, authTime time.Time) (messages.EncKDCRepPart, error) {
+	// the ticket's details are only known to the KDC and service so are read back from its encrypted part
+	skey, _, err := k.key(tkt.SName, tkt.EncPart.EType)
+	if err != nil {
+		return messages.EncKDCRepPart{}, err
+	}
+	err = tkt.Decrypt(skey)
+	if err != nil {
+		return messages.EncKDCRepPart{}, err
+	}
+	etp := tkt.DecryptedEncPart
+	return messages.EncKDCRepPart{
+		Key:       sessionKey,
+		LastReqs:  []messages.LastReq{{LRType: 0, LRValue: authTime}},
+		Nonce:     body.Nonce,
+		Flags:     etp.Flags,
+		AuthTime:  authTime,
+		StartTime: etp.StartTime,
+		EndTime:   etp.EndTime,
+		RenewTill: etp.RenewTill,
+		SRealm:    tkt.Realm,
+		SName:     tkt.SName,
+	}, nil
+}
+
+// key returns the principal's current key of the encryption type.
+func (k *KDC) key(princ types.PrincipalName, et int32) (types.EncryptionKey, int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	kvno, ok := k.kvnos[princ.PrincipalNameString()]
+	if !ok {
+		return types.EncryptionKey{}, 0, fmt.Errorf("principal %s@%s not found", princ.PrincipalNameString(), k.Realm)
+	}
+	return k.db.GetEncryptionKey(princ, k.Realm, int(kvno), et)
+}
+
+// etype returns the first of the requested encryption types the KDC supports.
+func (k *KDC) etype(requested []int32) (int32, bool) {
+	for _, r := range requested {
+		for _, et := range etypes {
+			if r == et {
+				return et, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// krbError is a KRB-ERROR to be returned to the client.
+type krbError struct {
+	messages.KRBError
+}
+
+func newKRBError(code int32, sname types.PrincipalName, etext string) krbError {
+	if len(sname.NameString) == 0 {
+		sname = types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt")
+	}
+	return krbError{messages.NewKRBError(sname, "", code, etext)}
+}
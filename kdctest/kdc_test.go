@@ -0,0 +1,152 @@
+package kdctest
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+)
+
+func TestKDC(t *testing.T) {
+	kdc, err := New("TEST.GOKRB5")
+	if err != nil {
+		t.Fatalf("could not start KDC: %v", err)
+	}
+	defer kdc.Close()
+	skt, err := kdc.AddPrincipal("HTTP/host.test.gokrb5")
+	if err != nil {
+		t.Fatalf("could not add service principal: %v", err)
+	}
+	cl, err := kdc.NewClient("testuser1")
+	if err != nil {
+		t.Fatalf("could not create client: %v", err)
+	}
+	err = cl.Login()
+	if err != nil {
+		t.Fatalf("could not login: %v", err)
+	}
+	tkt, key, err := cl.GetServiceTicket("HTTP/host.test.gokrb5")
+	if err != nil {
+		t.Fatalf("could not get service ticket: %v", err)
+	}
+
+	// the service must be able to validate the ticket with its keytab
+	tkn, err := spnego.NewKRB5TokenAPREQ(cl, tkt, key, nil, nil)
+	if err != nil {
+		t.Fatalf("could not create AP_REQ: %v", err)
+	}
+	ok, creds, err := service.VerifyAPREQ(&tkn.APReq, service.NewSettings(skt))
+	if !ok || err != nil {
+		t.Fatalf("service could not verify AP_REQ: %v", err)
+	}
+	if creds.UserName() != "testuser1" || creds.Domain() != "TEST.GOKRB5" {
+		t.Errorf("unexpected credentials %s@%s", creds.UserName(), creds.Domain())
+	}
+
+	_, _, err = cl.GetServiceTicket("HTTP/unknown.test.gokrb5")
+	if err == nil || !strings.Contains(err.Error(), "KDC_ERR_S_PRINCIPAL_UNKNOWN") {
+		t.Errorf("expected unknown principal error, got: %v", err)
+	}
+	if kdc.Requests() != 3 {
+		t.Errorf("expected 3 requests to the KDC, got %d", kdc.Requests())
+	}
+
+	// tickets issued after a key rotation use the new key
+	nkt, err := kdc.RotateKey("HTTP/host.test.gokrb5")
+	if err != nil {
+		t.Fatalf("could not rotate key: %v", err)
+	}
+	cl, err = kdc.NewClient("testuser2")
+	if err != nil {
+		t.Fatalf("could not create client: %v", err)
+	}
+	tkt, _, err = cl.GetServiceTicket("HTTP/host.test.gokrb5")
+	if err != nil {
+		t.Fatalf("could not get service ticket: %v", err)
+	}
+	if tkt.EncPart.KVNO != 2 {
+		t.Errorf("expected ticket with key version 2, got %d", tkt.EncPart.KVNO)
+	}
+	if err := tkt.DecryptEncPart(nkt, nil); err != nil {
+		t.Errorf("could not decrypt ticket with the rotated key: %v", err)
+	}
+}
+
+func TestKDC_CCache(t *testing.T) {
+	kdc, err := New("TEST.GOKRB5")
+	if err != nil {
+		t.Fatalf("could not start KDC: %v", err)
+	}
+	defer kdc.Close()
+	if _, err := kdc.AddPrincipal("HTTP/host.test.gokrb5"); err != nil {
+		t.Fatalf("could not add service principal: %v", err)
+	}
+	b, err := kdc.CCache("testuser1")
+	if err != nil {
+		t.Fatalf("could not create ccache: %v", err)
+	}
+	cc := new(credentials.CCache)
+	if err := cc.Unmarshal(b); err != nil {
+		t.Fatalf("could not unmarshal ccache: %v", err)
+	}
+	cfg, err := kdc.Config()
+	if err != nil {
+		t.Fatalf("could not get config: %v", err)
+	}
+	cl, err := client.NewFromCCache(cc, cfg)
+	if err != nil {
+		t.Fatalf("could not create client from ccache: %v", err)
+	}
+	if _, _, err := cl.GetServiceTicket("HTTP/host.test.gokrb5"); err != nil {
+		t.Errorf("could not get service ticket with TGT from ccache: %v", err)
+	}
+}
+
+func TestKDC_Trust(t *testing.T) {
+	home, err := New("HOME.GOKRB5")
+	if err != nil {
+		t.Fatalf("could not start KDC: %v", err)
+	}
+	defer home.Close()
+	partner, err := New("PARTNER.GOKRB5")
+	if err != nil {
+		t.Fatalf("could not start KDC: %v", err)
+	}
+	defer partner.Close()
+	if err := home.Trust(partner, "partner.example"); err != nil {
+		t.Fatalf("could not set up trust: %v", err)
+	}
+	cl, err := home.NewClient("testuser1")
+	if err != nil {
+		t.Fatalf("could not create client: %v", err)
+	}
+	if err := cl.Login(); err != nil {
+		t.Fatalf("could not login: %v", err)
+	}
+
+	// the realm of the first service is found from the krb5.conf, the second by the home KDC referring the client
+	for _, spn := range []string{"HTTP/host.partner.gokrb5", "HTTP/host.partner.example"} {
+		skt, err := partner.AddPrincipal(spn)
+		if err != nil {
+			t.Fatalf("could not add service principal: %v", err)
+		}
+		tkt, key, err := cl.GetServiceTicket(spn)
+		if err != nil {
+			t.Fatalf("could not get service ticket for %s: %v", spn, err)
+		}
+		tkn, err := spnego.NewKRB5TokenAPREQ(cl, tkt, key, nil, nil)
+		if err != nil {
+			t.Fatalf("could not create AP_REQ: %v", err)
+		}
+		ok, creds, err := service.VerifyAPREQ(&tkn.APReq, service.NewSettings(skt))
+		if !ok || err != nil {
+			t.Fatalf("service could not verify AP_REQ for %s: %v", spn, err)
+		}
+		if creds.UserName() != "testuser1" || creds.Domain() != "HOME.GOKRB5" {
+			t.Errorf("unexpected credentials %s@%s", creds.UserName(), creds.Domain())
+		}
+	}
+}
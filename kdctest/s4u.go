@@ -0,0 +1,136 @@
+package kdctest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/crypto/rfc4757"
+	"github.com/jcmturner/gokrb5/v8/iana/chksumtype"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// cnameInAddlTkt is the KDC option a service sets to obtain a ticket for the client of the additional ticket with S4U2Proxy.
+const cnameInAddlTkt = 14
+
+// paForUser is the PA-FOR-USER padata a service sends to obtain a ticket to itself for a user with S4U2Self.
+type paForUser struct {
+	UserName    types.PrincipalName `asn1:"explicit,tag:0"`
+	UserRealm   string              `asn1:"generalstring,explicit,tag:1"`
+	Cksum       types.Checksum      `asn1:"explicit,tag:2"`
+	AuthPackage string              `asn1:"generalstring,explicit,tag:3"`
+}
+
+// AllowProtocolTransition trusts the service to authenticate users for delegation, so that the tickets it obtains
+// for them with S4U2Self are forwardable and can be used with S4U2Proxy. Other services get tickets that are not.
+func (k *KDC) AllowProtocolTransition(service string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.protocolTransition[service] = true
+}
+
+// s4u2Self checks a request by the client of the TGT for a ticket to itself for the user named in the PA-FOR-USER.
+// The user's name and realm are returned. The forwardable option is dropped for services not trusted with protocol transition.
+func (k *KDC) s4u2Self(b []byte, body *messages.KDCReqBody, tgtPart messages.EncTicketPart) (types.PrincipalName, string, error) {
+	var pa paForUser
+	if _, err := asn1.Unmarshal(b, &pa); err != nil {
+		return types.PrincipalName{}, "", newKRBError(errorcode.KRB_ERR_GENERIC, body.SName, err.Error())
+	}
+	// a service may only obtain a ticket to itself
+	if !body.SName.Equal(tgtPart.CName) {
+		return types.PrincipalName{}, "", newKRBError(errorcode.KDC_ERR_BADOPTION, body.SName,
+			fmt.Sprintf("S4U2Self ticket requested by %s for %s", tgtPart.CName.PrincipalNameString(), body.SName.PrincipalNameString()))
+	}
+	if pa.Cksum.CksumType != chksumtype.KERB_CHECKSUM_HMAC_MD5 || pa.AuthPackage != "Kerberos" {
+		return types.PrincipalName{}, "", newKRBError(errorcode.KDC_ERR_BADOPTION, body.SName, "unsupported PA-FOR-USER checksum or auth package")
+	}
+	cksum, err := rfc4757.Checksum(tgtPart.Key.KeyValue, keyusage.KERB_NON_KERB_CKSUM_SALT, forUserChecksumData(pa))
+	if err != nil || !bytes.Equal(cksum, pa.Cksum.Checksum) {
+		return types.PrincipalName{}, "", newKRBError(errorcode.KRB_AP_ERR_MODIFIED, body.SName, "PA-FOR-USER checksum is invalid")
+	}
+	if pa.UserRealm != k.Realm {
+		return types.PrincipalName{}, "", newKRBError(errorcode.KDC_ERR_WRONG_REALM, body.SName, fmt.Sprintf("user realm %s is not %s", pa.UserRealm, k.Realm))
+	}
+	if _, _, err := k.key(pa.UserName, etypeID.AES256_CTS_HMAC_SHA1_96); err != nil {
+		return types.PrincipalName{}, "", newKRBError(errorcode.KDC_ERR_C_PRINCIPAL_UNKNOWN, body.SName, err.Error())
+	}
+	k.mu.Lock()
+	trusted := k.protocolTransition[tgtPart.CName.PrincipalNameString()]
+	k.mu.Unlock()
+	if !trusted {
+		types.UnsetFlag(&body.KDCOptions, flags.Forwardable)
+	}
+	return pa.UserName, pa.UserRealm, nil
+}
+
+// forUserChecksumData returns the data the PA-FOR-USER checksum is made over: the name type as a little endian
+// 32 bit integer followed by the name components, the realm and the auth package.
+func forUserChecksumData(pa paForUser) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(pa.UserName.NameType))
+	for _, n := range pa.UserName.NameString {
+		b = append(b, n...)
+	}
+	b = append(b, pa.UserRealm...)
+	return append(b, pa.AuthPackage...)
+}
+
+// AllowDelegation permits the service to obtain tickets to the target services for its callers with S4U2Proxy,
+// as constrained delegation configured in the KDC does.
+func (k *KDC) AllowDelegation(service string, targets ...string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.delegation[service] = append(k.delegation[service], targets...)
+}
+
+// s4u2Proxy checks a request by the client of the TGT for a ticket to a service for the client of the evidence ticket
+// it carries. The decrypted part of the evidence ticket is returned.
+func (k *KDC) s4u2Proxy(body messages.KDCReqBody, tgtPart messages.EncTicketPart) (messages.EncTicketPart, error) {
+	if len(body.AdditionalTickets) != 1 {
+		return messages.EncTicketPart{}, newKRBError(errorcode.KDC_ERR_BADOPTION, body.SName, "S4U2Proxy request must carry one evidence ticket")
+	}
+	ev := body.AdditionalTickets[0]
+	// the evidence ticket must have been issued to the service making the request
+	if !ev.SName.Equal(tgtPart.CName) || ev.Realm != k.Realm {
+		return messages.EncTicketPart{}, newKRBError(errorcode.KDC_ERR_BADOPTION, body.SName,
+			fmt.Sprintf("evidence ticket is for %s rather than %s", ev.SName.PrincipalNameString(), tgtPart.CName.PrincipalNameString()))
+	}
+	k.mu.Lock()
+	key, _, err := k.db.GetEncryptionKey(ev.SName, k.Realm, ev.EncPart.KVNO, ev.EncPart.EType)
+	k.mu.Unlock()
+	if err != nil {
+		return messages.EncTicketPart{}, newKRBError(errorcode.KDC_ERR_BADOPTION, body.SName, err.Error())
+	}
+	if err := ev.Decrypt(key); err != nil {
+		return messages.EncTicketPart{}, newKRBError(errorcode.KRB_AP_ERR_BAD_INTEGRITY, body.SName, err.Error())
+	}
+	if time.Now().UTC().After(ev.DecryptedEncPart.EndTime) {
+		return messages.EncTicketPart{}, newKRBError(errorcode.KRB_AP_ERR_TKT_EXPIRED, body.SName, "evidence ticket has expired")
+	}
+	if !types.IsFlagSet(&ev.DecryptedEncPart.Flags, flags.Forwardable) {
+		return messages.EncTicketPart{}, newKRBError(errorcode.KDC_ERR_BADOPTION, body.SName, "evidence ticket is not forwardable")
+	}
+	if !k.delegationAllowed(tgtPart.CName.PrincipalNameString(), body.SName.PrincipalNameString()) {
+		return messages.EncTicketPart{}, newKRBError(errorcode.KDC_ERR_BADOPTION, body.SName,
+			fmt.Sprintf("%s is not allowed to delegate to %s", tgtPart.CName.PrincipalNameString(), body.SName.PrincipalNameString()))
+	}
+	return ev.DecryptedEncPart, nil
+}
+
+func (k *KDC) delegationAllowed(service, target string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, t := range k.delegation[service] {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package kdctest
+
+import (
+	"strings"
+
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// trust is a realm the KDC issues cross-realm TGTs for.
+type trust struct {
+	kdc *KDC
+	// domains are the DNS domains of hosts in the realm that requests for unknown services are referred to it for
+	domains []string
+}
+
+// Trust lets the principals of the KDC's realm obtain tickets for services in the other KDC's realm, as a one way
+// cross-realm trust does. The cross-realm TGT principal krbtgt/OTHER@REALM is created with its key shared by both KDCs.
+// Requests for services the KDC does not know on hosts in the domains, and for TGTs for realms the other KDC trusts,
+// are answered with a referral to the other realm.
+func (k *KDC) Trust(other *KDC, domains ...string) error {
+	k.mu.Lock()
+	kt, err := k.addKeys("krbtgt/"+other.Realm, 1)
+	if err == nil {
+		k.trusts = append(k.trusts, trust{kdc: other, domains: domains})
+	}
+	k.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	other.mu.Lock()
+	defer other.mu.Unlock()
+	other.db.Entries = append(other.db.Entries, kt.Entries...)
+	return nil
+}
+
+// referral returns the trusted realm to refer a request for the service to, if any.
+func (k *KDC) referral(sname types.PrincipalName) (string, bool) {
+	k.mu.Lock()
+	trusts := append([]trust(nil), k.trusts...)
+	k.mu.Unlock()
+	if len(sname.NameString) != 2 {
+		return "", false
+	}
+	for _, t := range trusts {
+		if sname.NameString[0] == "krbtgt" {
+			// refer TGT requests to a realm on the path to the one asked for
+			for _, tt := range t.kdc.trustedRealms() {
+				if tt == sname.NameString[1] {
+					return t.kdc.Realm, true
+				}
+			}
+			continue
+		}
+		host := strings.ToLower(sname.NameString[1])
+		for _, d := range t.domains {
+			d = strings.ToLower(strings.TrimPrefix(d, "."))
+			if host == d || strings.HasSuffix(host, "."+d) {
+				return t.kdc.Realm, true
+			}
+		}
+	}
+	return "", false
+}
+
+// trustedRealms returns the realms the KDC issues cross-realm TGTs for.
+func (k *KDC) trustedRealms() []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	realms := make([]string, len(k.trusts))
+	for i, t := range k.trusts {
+		realms[i] = t.kdc.Realm
+	}
+	return realms
+}
+
+// trusted returns the KDC followed by the KDCs of the realms it trusts directly or through others.
+func (k *KDC) trusted() []*KDC {
+	kdcs := []*KDC{k}
+	seen := map[string]bool{k.Realm: true}
+	for n := 0; n < len(kdcs); n++ {
+		kdcs[n].mu.Lock()
+		trusts := append([]trust(nil), kdcs[n].trusts...)
+		kdcs[n].mu.Unlock()
+		for _, t := range trusts {
+			if !seen[t.kdc.Realm] {
+				seen[t.kdc.Realm] = true
+				kdcs = append(kdcs, t.kdc)
+			}
+		}
+	}
+	return kdcs
+}
@@ -0,0 +1,185 @@
+package grpc_krb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/keytab"
+)
+
+// KeytabSource provides the keytab used by the server interceptor, which may change while the server is running.
+type KeytabSource interface {
+	Keytab() *keytab.Keytab
+}
+
+// defaultKeytabPollInterval is how often FileKeytabSource checks the file for changes when PollInterval is not set.
+const defaultKeytabPollInterval = 10 * time.Second
+
+// FileKeytabSource loads a keytab file and reloads it whenever the file changes,
+// so service keys can be rotated without restarting the server.
+// The new keytab is swapped in atomically. If it cannot be loaded the last keytab loaded stays in use.
+// Call Start to load the file before use and Close once finished with.
+type FileKeytabSource struct {
+	Path string
+	// PollInterval is how often the file is checked for changes. Defaults to 10 seconds.
+	PollInterval time.Duration
+	// GracePeriod is how long keys dropped from the file by a reload are still accepted,
+	// so tickets already issued under the previous key version remain valid until clients renew them.
+	GracePeriod time.Duration
+	// OnReload is called after each attempt to reload the changed file with the keytab now in use or the error loading it.
+	OnReload func(kt *keytab.Keytab, err error)
+
+	mux     sync.RWMutex
+	kt      *keytab.Keytab
+	loaded  *keytab.Keytab
+	retired []retiredKeys
+	expires time.Time
+	modTime time.Time
+	size    int64
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// retiredKeys are keys dropped from the file by a reload that are accepted until the grace period ends.
+type retiredKeys struct {
+	kt    *keytab.Keytab
+	until time.Time
+}
+
+// Start loads the keytab file and begins watching it for changes.
+func (s *FileKeytabSource) Start() error {
+	if _, err := s.reload(); err != nil {
+		return err
+	}
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.watch()
+	return nil
+}
+
+// Close stops watching the keytab file. The keytab last loaded remains available.
+func (s *FileKeytabSource) Close() {
+	s.closeOnce.Do(func() {
+		if s.stop == nil {
+			return
+		}
+		close(s.stop)
+		<-s.done
+	})
+}
+
+// Keytab returns the keytab loaded from the file together with any keys still within their grace period.
+func (s *FileKeytabSource) Keytab() *keytab.Keytab {
+	now := time.Now()
+	s.mux.RLock()
+	if s.expires.IsZero() || now.Before(s.expires) {
+		defer s.mux.RUnlock()
+		return s.kt
+	}
+	s.mux.RUnlock()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.compose(now)
+	return s.kt
+}
+
+func (s *FileKeytabSource) watch() {
+	defer close(s.done)
+	interval := s.PollInterval
+	if interval <= 0 {
+		interval = defaultKeytabPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			changed, err := s.reload()
+			if changed && s.OnReload != nil {
+				s.OnReload(s.Keytab(), err)
+			}
+		}
+	}
+}
+
+// reload loads the keytab file if it has changed since it was last loaded, reporting whether it had.
+func (s *FileKeytabSource) reload() (bool, error) {
+	fi, err := os.Stat(s.Path)
+	if err != nil {
+		return false, fmt.Errorf("could not read keytab %s: %v", s.Path, err)
+	}
+	s.mux.RLock()
+	unchanged := fi.ModTime().Equal(s.modTime) && fi.Size() == s.size
+	s.mux.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	kt, err := keytab.Load(s.Path)
+	if err == nil && len(kt.Entries) == 0 {
+		err = errors.New("keytab has no entries")
+	}
+
+	now := time.Now()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	// a file that failed to load is not tried again until it changes
+	s.modTime, s.size = fi.ModTime(), fi.Size()
+	if err != nil {
+		return true, fmt.Errorf("could not load keytab %s: %v", s.Path, err)
+	}
+	if s.loaded != nil && s.GracePeriod > 0 {
+		dropped := keytab.New()
+		for _, e := range s.loaded.Entries {
+			if !hasKey(kt, e.Principal.String(), e.KVNO, e.Key.KeyType) {
+				dropped.Entries = append(dropped.Entries, e)
+			}
+		}
+		if len(dropped.Entries) > 0 {
+			s.retired = append(s.retired, retiredKeys{kt: dropped, until: now.Add(s.GracePeriod)})
+		}
+	}
+	s.loaded = kt
+	s.compose(now)
+	return true, nil
+}
+
+// compose builds the keytab in use from that loaded and the retired keys still within their grace period.
+func (s *FileKeytabSource) compose(now time.Time) {
+	kt := keytab.New()
+	kt.Entries = append(kt.Entries, s.loaded.Entries...)
+	s.expires = time.Time{}
+	var retired []retiredKeys
+	for _, r := range s.retired {
+		if !now.Before(r.until) {
+			continue
+		}
+		retired = append(retired, r)
+		if s.expires.IsZero() || r.until.Before(s.expires) {
+			s.expires = r.until
+		}
+		for _, e := range r.kt.Entries {
+			if !hasKey(kt, e.Principal.String(), e.KVNO, e.Key.KeyType) {
+				kt.Entries = append(kt.Entries, e)
+			}
+		}
+	}
+	s.retired = retired
+	s.kt = kt
+}
+
+// hasKey reports whether the keytab holds the key for the principal, in the form name@REALM, at the key version and encryption type.
+func hasKey(kt *keytab.Keytab, princ string, kvno uint32, etype int32) bool {
+	for _, e := range kt.Entries {
+		if e.Principal.String() == princ && e.KVNO == kvno && e.Key.KeyType == etype {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package grpc_krb
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/grpckrb/test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFileKeytabSource(t *testing.T) {
+	const spn = "GRPC/rotate.test.gokrb5"
+	kt, err := testKDC.AddPrincipal(spn)
+	if err != nil {
+		t.Fatalf("could not add principal: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "grpckrb")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "service.keytab")
+	write := func(b []byte) {
+		// replace the file atomically as a deployment would
+		tmp := path + ".tmp"
+		if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+			t.Fatalf("could not write keytab: %v", err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			t.Fatalf("could not replace keytab: %v", err)
+		}
+	}
+	writeKeytab := func(kt *keytab.Keytab) {
+		b, err := kt.Marshal()
+		if err != nil {
+			t.Fatalf("could not marshal keytab: %v", err)
+		}
+		write(b)
+	}
+	writeKeytab(kt)
+
+	reloads := make(chan error, 1)
+	src := &FileKeytabSource{
+		Path:         path,
+		PollInterval: 10 * time.Millisecond,
+		GracePeriod:  time.Second,
+		OnReload: func(kt *keytab.Keytab, err error) {
+			reloads <- err
+		},
+	}
+	if err := src.Start(); err != nil {
+		t.Fatalf("could not start keytab source: %v", err)
+	}
+	defer src.Close()
+
+	si := &KRBServerInterceptor{
+		Settings:     service.NewSettings(nil, service.Logger(log.New(os.Stdout, "KRB: ", log.LstdFlags))),
+		KeytabSource: src,
+	}
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	srv := grpc.NewServer(grpc.UnaryInterceptor(si.Unary()))
+	test.RegisterServiceServer(srv, new(test.Server))
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	call := func(ci *KRBClientInterceptor) error {
+		_, err := sendUnaryMessageWithInterceptor(lis.Addr().String(), ci)
+		return err
+	}
+	// this client holds a ticket under the first key version throughout
+	before := newClientInterceptor(spn, "testuser1")
+	defer before.Close()
+	if err := call(before); err != nil {
+		t.Fatalf("call with initial keytab failed: %v", err)
+	}
+
+	nkt, err := testKDC.RotateKey(spn)
+	if err != nil {
+		t.Fatalf("could not rotate key: %v", err)
+	}
+	writeKeytab(nkt)
+	if err := <-reloads; err != nil {
+		t.Fatalf("reload of rotated keytab failed: %v", err)
+	}
+	after := newClientInterceptor(spn, "testuser2")
+	defer after.Close()
+	if err := call(after); err != nil {
+		t.Errorf("call with ticket for the new key failed: %v", err)
+	}
+	if err := call(before); err != nil {
+		t.Errorf("call with ticket for the previous key failed within the grace period: %v", err)
+	}
+
+	// a corrupt keytab leaves the last good one in place
+	write([]byte{0x05, 0x02, 0xff})
+	if err := <-reloads; err == nil {
+		t.Error("expected an error reloading a corrupt keytab")
+	}
+	if err := call(after); err != nil {
+		t.Errorf("call failed after a corrupt reload: %v", err)
+	}
+
+	time.Sleep(time.Second)
+	if err := call(before); ErrorReason(err) != ReasonWrongSPN {
+		t.Errorf("expected ticket for the previous key to be rejected after the grace period, got: %v", err)
+	}
+	if err := call(after); err != nil {
+		t.Errorf("call with ticket for the new key failed after the grace period: %v", err)
+	}
+}
+
+func TestFileKeytabSource_NotLoaded(t *testing.T) {
+	// the source is not started so has no keytab
+	si := &KRBServerInterceptor{
+		Settings:     service.NewSettings(nil, service.Logger(log.New(os.Stdout, "KRB: ", log.LstdFlags))),
+		KeytabSource: &FileKeytabSource{Path: "service.keytab"},
+	}
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	srv := grpc.NewServer(grpc.UnaryInterceptor(si.Unary()))
+	test.RegisterServiceServer(srv, new(test.Server))
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	ci := newClientInterceptor("", "testuser1")
+	defer ci.Close()
+	_, err = sendUnaryMessageWithInterceptor(lis.Addr().String(), ci)
+	if status.Code(err) != codes.Unavailable || ErrorReason(err) != ReasonKeytabUnavailable {
+		t.Errorf("expected call to fail as unavailable before the keytab is loaded, got: %v", err)
+	}
+}
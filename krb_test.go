@@ -2,50 +2,47 @@ package grpc_krb
 
 import (
 	"context"
-	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"sync/atomic"
 	"testing"
+	"time"
 
-	"github.com/jcmturner/gokrb5/v8/config"
-	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/grpckrb/kdctest"
 	"github.com/jcmturner/grpckrb/test"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/tap"
 
+	"github.com/jcmturner/gokrb5/v8/messages"
 	"github.com/jcmturner/gokrb5/v8/service"
-
-	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/types"
 )
 
-const (
-	krb5conf = `[libdefaults]
-  default_realm = TEST.GOKRB5
-  dns_lookup_realm = false
-  dns_lookup_kdc = false
-  ticket_lifetime = 24h
-  forwardable = yes
-  default_tkt_enctypes = aes256-cts-hmac-sha1-96
-  default_tgs_enctypes = aes256-cts-hmac-sha1-96
-
-[realms]
- TEST.GOKRB5 = {
-  kdc = 127.0.0.1:88
-  admin_server = 127.0.0.1:749
-  default_domain = test.gokrb5
- }
-
-[domain_realm]
- .test.gokrb5 = TEST.GOKRB5
- test.gokrb5 = TEST.GOKRB5
- `
-	testuser1Keytab              = "05020000003b0001000b544553542e474f4b52423500097465737475736572310000000159beb1d80100110010698c4df8e9f60e7eea5a21bf4526ad25000000010000004b0001000b544553542e474f4b52423500097465737475736572310000000159beb1d80100120020bbdc430aab7e2d4622a0b6951481453b0962e9db8e2f168942ad175cda6d9de9000000010000003b0001000b544553542e474f4b52423500097465737475736572310000000159beb1d80200110010698c4df8e9f60e7eea5a21bf4526ad25000000020000004b0001000b544553542e474f4b52423500097465737475736572310000000159beb1d80200120020bbdc430aab7e2d4622a0b6951481453b0962e9db8e2f168942ad175cda6d9de9000000020000003b0001000b544553542e474f4b52423500097465737475736572310000000159beb1d801001300102eb8501967a7886e1f0c63ac9be8c4a0000000010000003b0001000b544553542e474f4b52423500097465737475736572310000000159beb1d802001300102eb8501967a7886e1f0c63ac9be8c4a0000000020000004b0001000b544553542e474f4b52423500097465737475736572310000000159beb1d801001400208ad66f209bb07daa186f8a229830f5ba06a3a2a33638f4ec66e1d29324e417ee000000010000004b0001000b544553542e474f4b52423500097465737475736572310000000159beb1d802001400208ad66f209bb07daa186f8a229830f5ba06a3a2a33638f4ec66e1d29324e417ee00000002000000430001000b544553542e474f4b52423500097465737475736572310000000159beb1d801001000184580fb91760dabe6f808c22c26494f644cb35d61d32c79e300000001000000430001000b544553542e474f4b52423500097465737475736572310000000159beb1d802001000184580fb91760dabe6f808c22c26494f644cb35d61d32c79e3000000020000003b0001000b544553542e474f4b52423500097465737475736572310000000159beb1d80100170010084768c373663b3bef1f6385883cf7ff000000010000003b0001000b544553542e474f4b52423500097465737475736572310000000159beb1d80200170010084768c373663b3bef1f6385883cf7ff00000002"
-	testuser2Keytab              = "05020000003b0001000b544553542e474f4b52423500097465737475736572320000000159beb240010011001086824c55ff5de30386dd83dc62b44bb7000000010000004b0001000b544553542e474f4b52423500097465737475736572320000000159beb2400100120020d8ed27f96be76fd5b281ee9f8029db93cc5fb06c7eb3be9ee753106d3488fa92000000010000003b0001000b544553542e474f4b52423500097465737475736572320000000159beb240020011001086824c55ff5de30386dd83dc62b44bb7000000020000004b0001000b544553542e474f4b52423500097465737475736572320000000159beb2400200120020d8ed27f96be76fd5b281ee9f8029db93cc5fb06c7eb3be9ee753106d3488fa92000000020000003b0001000b544553542e474f4b52423500097465737475736572320000000159beb24001001300106ccff358aaa8a4a41c444e173b1463c2000000010000003b0001000b544553542e474f4b52423500097465737475736572320000000159beb24002001300106ccff358aaa8a4a41c444e173b1463c2000000020000004b0001000b544553542e474f4b52423500097465737475736572320000000159beb24001001400205cf3773dd920be800229ac1c6f9bf59c6706c583f82c2dea66c9a29152118cd7000000010000004b0001000b544553542e474f4b52423500097465737475736572320000000159beb24002001400205cf3773dd920be800229ac1c6f9bf59c6706c583f82c2dea66c9a29152118cd700000002000000430001000b544553542e474f4b52423500097465737475736572320000000159beb2400100100018bc025746e9e66bd6b62a918f6413d529803192a28aabf79200000001000000430001000b544553542e474f4b52423500097465737475736572320000000159beb2400200100018bc025746e9e66bd6b62a918f6413d529803192a28aabf792000000020000003b0001000b544553542e474f4b52423500097465737475736572320000000159beb2400100170010084768c373663b3bef1f6385883cf7ff000000010000003b0001000b544553542e474f4b52423500097465737475736572320000000159beb2400200170010084768c373663b3bef1f6385883cf7ff00000002"
-	testuser1KeytabWrongPassword = "0502000000370001000b544553542e474f4b52423500097465737475736572310000000158ef4bc5010011001039a9a382153105f8708e80f93382654e000000470001000b544553542e474f4b52423500097465737475736572310000000158ef4bc60100120020fc5bb940d6075214e0c6fc0456ce68c33306094198a927b4187d7cf3f4aea50d"
-	serviceKeytab                = "0502000000440002000b544553542e474f4b5242350004485454500010686f73742e746573742e676f6b72623500000001590dc4dc010011001057a7754c70c4d85c155c718c2f1292b0000000540002000b544553542e474f4b5242350004485454500010686f73742e746573742e676f6b72623500000001590dc4dc01001200209cad00bbc72d703258e911dc18e6d5487cf737bf67fd111f0c2463ad6033bf51000000440002000b544553542e474f4b5242350004485454500010686f73742e746573742e676f6b72623500000001590dc4dc020011001057a7754c70c4d85c155c718c2f1292b0000000540002000b544553542e474f4b5242350004485454500010686f73742e746573742e676f6b72623500000001590dc4dc02001200209cad00bbc72d703258e911dc18e6d5487cf737bf67fd111f0c2463ad6033bf51"
-)
+// testKDC is the in-memory KDC the tests authenticate against.
+var testKDC *kdctest.KDC
+
+func TestMain(m *testing.M) {
+	kdc, err := kdctest.New("TEST.GOKRB5")
+	if err != nil {
+		log.Fatalf("could not start test KDC: %v", err)
+	}
+	for _, p := range []string{"testuser1", "testuser2", "HTTP/host.test.gokrb5"} {
+		_, err = kdc.AddPrincipal(p)
+		if err != nil {
+			log.Fatalf("could not add principal %s to test KDC: %v", p, err)
+		}
+	}
+	testKDC = kdc
+	code := m.Run()
+	kdc.Close()
+	os.Exit(code)
+}
 
 func TestUnary_ValidAuthn_ValidAuthz(t *testing.T) {
 	srv, addr, errChan := newTestServer(0)
@@ -53,7 +50,7 @@ func TestUnary_ValidAuthn_ValidAuthz(t *testing.T) {
 		t.Fatal("could not create grpc server")
 	}
 
-	_, err := sendUnaryMessage(addr.String(), "", "testuser1", testuser1Keytab)
+	_, err := sendUnaryMessage(addr.String(), "", "testuser1")
 	if err != nil {
 		t.Fatalf("error in sending message: %v", err)
 	}
@@ -70,7 +67,7 @@ func TestStream_ValidAuthn_ValidAuthz(t *testing.T) {
 	if srv == nil {
 		t.Fatal("could not create grpc server")
 	}
-	conn, err := connect(addr.String(), "", "testuser1", testuser1Keytab)
+	conn, err := connect(addr.String(), "", "testuser1")
 	if err != nil {
 		t.Fatalf("could not create client connection: %v", err)
 	}
@@ -127,10 +124,13 @@ func TestUnary_InValidAuthn(t *testing.T) {
 	// Sending this ticket to the service is not valid to authenticate the user and therefore auth should fail.
 	// We could request any other SPN other than the correct one to simulate this.
 	// We are just using the username as it is a principal we can definitely get a ticket for from the KDC.
-	_, err := sendUnaryMessage(addr.String(), "testuser1", "testuser1", testuser1Keytab)
+	_, err := sendUnaryMessage(addr.String(), "testuser1", "testuser1")
 	if err == nil {
 		t.Fatal("call to service should have failed with an authentication error")
 	}
+	if status.Code(err) != codes.Unauthenticated || ErrorReason(err) != ReasonWrongSPN {
+		t.Errorf("unexpected error for authentication failure: %v", err)
+	}
 	go srv.GracefulStop()
 	for err := range errChan {
 		if err != nil {
@@ -145,10 +145,13 @@ func TestUnary_ValidAuthn_InvalidAuthz(t *testing.T) {
 		t.Fatal("could not create grpc server")
 	}
 
-	_, err := sendUnaryMessage(addr.String(), "", "testuser2", testuser2Keytab)
+	_, err := sendUnaryMessage(addr.String(), "", "testuser2")
 	if err == nil {
 		t.Fatal("call to service should have failed with an authorization error")
 	}
+	if status.Code(err) != codes.PermissionDenied || ErrorReason(err) != ReasonPermissionDenied {
+		t.Errorf("unexpected error for authorization failure: %v", err)
+	}
 	go srv.GracefulStop()
 	for err := range errChan {
 		if err != nil {
@@ -168,7 +171,7 @@ func TestStream_InValidAuthn(t *testing.T) {
 	// Sending this ticket to the service is not valid to authenticate the user and therefore auth should fail.
 	// We could request any other SPN other than the correct one to simulate this.
 	// We are just using the username as it is a principal we can definitely get a ticket for from the KDC.
-	conn, err := connect(addr.String(), "testuser1", "testuser1", testuser1Keytab)
+	conn, err := connect(addr.String(), "testuser1", "testuser1")
 	if err != nil {
 		t.Fatalf("could not create client connection: %v", err)
 	}
@@ -222,7 +225,7 @@ func TestStream_ValidAuthn_InvalidAuthz(t *testing.T) {
 		t.Fatal("could not create grpc server")
 	}
 	defer srv.GracefulStop()
-	conn, err := connect(addr.String(), "", "testuser2", testuser2Keytab)
+	conn, err := connect(addr.String(), "", "testuser2")
 	if err != nil {
 		t.Fatalf("could not create client connection: %v", err)
 	}
@@ -270,12 +273,8 @@ func TestStream_ValidAuthn_InvalidAuthz(t *testing.T) {
 	}
 }
 
-func connect(addr, spn, username, ktHex string) (*grpc.ClientConn, error) {
-	kcfg, _ := config.NewFromString(krb5conf)
-	b, _ := hex.DecodeString(ktHex)
-	kt := keytab.New()
-	kt.Unmarshal(b)
-	cl := client.NewWithKeytab(username, "TEST.GOKRB5", kt, kcfg)
+func newClientInterceptor(spn, username string) *KRBClientInterceptor {
+	cl, _ := testKDC.NewClient(username)
 
 	ci := &KRBClientInterceptor{
 		KRBClient:  cl,
@@ -285,19 +284,587 @@ func connect(addr, spn, username, ktHex string) (*grpc.ClientConn, error) {
 	if ci.DefaultSPN == "" {
 		ci.DefaultSPN = "HTTP/host.test.gokrb5"
 	}
+	return ci
+}
+
+func TestUnary_MutualAuth(t *testing.T) {
+	srv, addr, errChan := newTestServer(0)
+	if srv == nil {
+		t.Fatal("could not create grpc server")
+	}
+
+	ci := newClientInterceptor("", "testuser1")
+	ci.MutualAuth = true
+	_, err := sendUnaryMessageWithInterceptor(addr.String(), ci)
+	if err != nil {
+		t.Fatalf("error in sending message: %v", err)
+	}
+	go srv.GracefulStop()
+	for err := range errChan {
+		if err != nil {
+			t.Errorf("error from grpc server: %v", err)
+		}
+	}
+}
+
+func TestStream_MutualAuth(t *testing.T) {
+	srv, addr, errChan := newTestServer(0)
+	if srv == nil {
+		t.Fatal("could not create grpc server")
+	}
+	ci := newClientInterceptor("", "testuser1")
+	ci.MutualAuthMethods = map[string]bool{"/Service/Mirror": true}
+	conn, err := connectWithInterceptor(addr.String(), ci)
+	if err != nil {
+		t.Fatalf("could not create client connection: %v", err)
+	}
+	defer conn.Close()
+	client := test.NewServiceClient(conn)
+	stream, err := client.Mirror(context.Background())
+	if err != nil {
+		t.Fatalf("could not create client stream: %v", err)
+	}
+	err = stream.Send(&test.Request{
+		RequestInt: 1,
+		RequestStr: "test message",
+	})
+	if err != nil {
+		t.Errorf("error sending message: %v", err)
+	}
+	stream.CloseSend()
+	for {
+		_, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Errorf("error receiving reply: %v", err)
+			break
+		}
+	}
+
+	go srv.GracefulStop()
+	for err := range errChan {
+		if err != nil {
+			t.Errorf("error from grpc server: %v", err)
+		}
+	}
+}
+
+func TestStream_MutualAuthUnauthorised(t *testing.T) {
+	srv, addr, _ := newTestServer(0)
+	if srv == nil {
+		t.Fatal("could not create grpc server")
+	}
+	defer srv.Stop()
+	// the server rejects the caller so sends no AP_REP, and the client must report why rather than the missing AP_REP
+	ci := newClientInterceptor("", "testuser2")
+	ci.MutualAuth = true
+	defer ci.Close()
+	conn, err := connectWithInterceptor(addr.String(), ci)
+	if err != nil {
+		t.Fatalf("could not create client connection: %v", err)
+	}
+	defer conn.Close()
+	client := test.NewServiceClient(conn)
+	stream, err := client.Mirror(context.Background())
+	if err != nil {
+		t.Fatalf("could not create client stream: %v", err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.PermissionDenied || ErrorReason(err) != ReasonPermissionDenied {
+		t.Errorf("expected the stream to be denied, got: %v", err)
+	}
+	stream, err = client.Mirror(context.Background())
+	if err != nil {
+		t.Fatalf("could not create client stream: %v", err)
+	}
+	if _, err := stream.Header(); status.Code(err) != codes.PermissionDenied || ErrorReason(err) != ReasonPermissionDenied {
+		t.Errorf("expected the stream header to report the denial, got: %v", err)
+	}
+}
+
+func TestUnary_SPNEGO(t *testing.T) {
+	srv, addr, errChan := newTestServer(0)
+	if srv == nil {
+		t.Fatal("could not create grpc server")
+	}
+
+	ci := newClientInterceptor("", "testuser1")
+	ci.TokenFormat = TokenFormatSPNEGO
+	ci.MutualAuth = true
+	_, err := sendUnaryMessageWithInterceptor(addr.String(), ci)
+	if err != nil {
+		t.Fatalf("error in sending message: %v", err)
+	}
+	go srv.GracefulStop()
+	for err := range errChan {
+		if err != nil {
+			t.Errorf("error from grpc server: %v", err)
+		}
+	}
+}
+
+func TestUnary_GSSAPI(t *testing.T) {
+	srv, addr, errChan := newTestServer(0)
+	if srv == nil {
+		t.Fatal("could not create grpc server")
+	}
+
+	ci := newClientInterceptor("", "testuser1")
+	ci.TokenFormat = TokenFormatGSSAPI
+	ci.MutualAuth = true
+	_, err := sendUnaryMessageWithInterceptor(addr.String(), ci)
+	if err != nil {
+		t.Fatalf("error in sending message: %v", err)
+	}
+	go srv.GracefulStop()
+	for err := range errChan {
+		if err != nil {
+			t.Errorf("error from grpc server: %v", err)
+		}
+	}
+}
 
+func TestIdentityFromContext(t *testing.T) {
+	var unaryPrinc, streamPrinc *Principal
+	unary := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		unaryPrinc, _ = IdentityFromContext(ctx)
+		return handler(ctx, req)
+	}
+	stream := func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		streamPrinc, _ = IdentityFromContext(ss.Context())
+		return handler(srv, ss)
+	}
+	srv, addr, errChan := newTestServer(0, grpc.ChainUnaryInterceptor(unary), grpc.ChainStreamInterceptor(stream))
+	if srv == nil {
+		t.Fatal("could not create grpc server")
+	}
+
+	conn, err := connect(addr.String(), "", "testuser1")
+	if err != nil {
+		t.Fatalf("could not create client connection: %v", err)
+	}
+	defer conn.Close()
+	client := test.NewServiceClient(conn)
+	_, err = client.Reflector(context.Background(), &test.Request{RequestInt: 1})
+	if err != nil {
+		t.Fatalf("error in sending message: %v", err)
+	}
+	ms, err := client.Mirror(context.Background())
+	if err != nil {
+		t.Fatalf("could not create client stream: %v", err)
+	}
+	ms.CloseSend()
+	for {
+		_, err := ms.Recv()
+		if err != nil {
+			break
+		}
+	}
+
+	go srv.GracefulStop()
+	for err := range errChan {
+		if err != nil {
+			t.Errorf("error from grpc server: %v", err)
+		}
+	}
+	for _, p := range []*Principal{unaryPrinc, streamPrinc} {
+		if p == nil {
+			t.Fatal("identity not available from the handler context")
+		}
+		if p.String() != "testuser1@TEST.GOKRB5" {
+			t.Errorf("unexpected principal %s", p)
+		}
+		if p.EndTime.Before(time.Now()) {
+			t.Errorf("principal ticket end time %v not in the future", p.EndTime)
+		}
+	}
+}
+
+func TestUnary_KDCUnreachable(t *testing.T) {
+	srv, addr, errChan := newTestServer(0)
+	if srv == nil {
+		t.Fatal("could not create grpc server")
+	}
+
+	ci := newUnreachableKDCInterceptor(t)
+	_, err := sendUnaryMessageWithInterceptor(addr.String(), ci)
+	if status.Code(err) != codes.Unavailable || ErrorReason(err) != ReasonKDCUnreachable {
+		t.Errorf("unexpected error when KDC is unreachable: %v", err)
+	}
+	go srv.GracefulStop()
+	for err := range errChan {
+		if err != nil {
+			t.Errorf("error from grpc server: %v", err)
+		}
+	}
+}
+
+func TestUnary_KDCStalled(t *testing.T) {
+	srv, addr, errChan := newTestServer(0)
+	if srv == nil {
+		t.Fatal("could not create grpc server")
+	}
+	var tests = []struct {
+		name       string
+		kdcTimeout time.Duration
+		ctx        func() (context.Context, context.CancelFunc)
+		code       codes.Code
+		reason     string
+	}{
+		{"deadline", 0, func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 200*time.Millisecond)
+		}, codes.DeadlineExceeded, ""},
+		{"cancel", 0, func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(200*time.Millisecond, cancel)
+			return ctx, cancel
+		}, codes.Canceled, ""},
+		{"kdc timeout", 200 * time.Millisecond, func() (context.Context, context.CancelFunc) {
+			return context.WithCancel(context.Background())
+		}, codes.Unavailable, ReasonKDCUnreachable},
+		{"deadline impersonating", 0, func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(ContextWithImpersonation(context.Background(), "testuser1"), 200*time.Millisecond)
+		}, codes.DeadlineExceeded, ""},
+		{"kdc timeout impersonating", 200 * time.Millisecond, func() (context.Context, context.CancelFunc) {
+			return context.WithCancel(ContextWithImpersonation(context.Background(), "testuser1"))
+		}, codes.Unavailable, ReasonKDCUnreachable},
+	}
+	for _, tt := range tests {
+		ci := newStalledKDCInterceptor(t)
+		ci.Impersonation = true
+		ci.KDCTimeout = tt.kdcTimeout
+		conn, err := connectWithInterceptor(addr.String(), ci)
+		if err != nil {
+			t.Fatalf("could not create client connection: %v", err)
+		}
+		ctx, cancel := tt.ctx()
+		start := time.Now()
+		_, err = test.NewServiceClient(conn).Reflector(ctx, &test.Request{RequestInt: 1})
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("%s: call took %v to return while the KDC was stalled", tt.name, d)
+		}
+		if status.Code(err) != tt.code || ErrorReason(err) != tt.reason {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+		cancel()
+		conn.Close()
+	}
+	go srv.GracefulStop()
+	for err := range errChan {
+		if err != nil {
+			t.Errorf("error from grpc server: %v", err)
+		}
+	}
+}
+
+func TestOnTokenError(t *testing.T) {
+	var tests = []struct {
+		policy     TokenErrorPolicy
+		code       codes.Code
+		reason     string
+		serverSees bool
+	}{
+		{TokenErrorFail, codes.Unavailable, ReasonKDCUnreachable, false},
+		{TokenErrorRetryAfterRelogin, codes.Unavailable, ReasonKDCUnreachable, false},
+		// the server receives the call without a token and rejects it
+		{TokenErrorProceedUnauthenticated, codes.Unauthenticated, ReasonMissingToken, true},
+	}
+	for _, tt := range tests {
+		var calls int32
+		countCalls := func(ctx context.Context, info *tap.Info) (context.Context, error) {
+			atomic.AddInt32(&calls, 1)
+			return ctx, nil
+		}
+		srv, addr, errChan := newTestServer(0, grpc.InTapHandle(countCalls))
+		if srv == nil {
+			t.Fatal("could not create grpc server")
+		}
+		ci := newUnreachableKDCInterceptor(t)
+		ci.OnTokenError = tt.policy
+		conn, err := connectWithInterceptor(addr.String(), ci)
+		if err != nil {
+			t.Fatalf("could not create client connection: %v", err)
+		}
+		client := test.NewServiceClient(conn)
+
+		_, err = client.Reflector(context.Background(), &test.Request{RequestInt: 1})
+		if status.Code(err) != tt.code || ErrorReason(err) != tt.reason {
+			t.Errorf("policy %d: unexpected unary error: %v", tt.policy, err)
+		}
+		stream, err := client.Mirror(context.Background())
+		if err == nil {
+			_, err = stream.Recv()
+		} else if stream != nil {
+			t.Errorf("policy %d: stream returned along with error %v", tt.policy, err)
+		}
+		if status.Code(err) != tt.code || ErrorReason(err) != tt.reason {
+			t.Errorf("policy %d: unexpected stream error: %v", tt.policy, err)
+		}
+		conn.Close()
+
+		go srv.GracefulStop()
+		for err := range errChan {
+			if err != nil {
+				t.Errorf("error from grpc server: %v", err)
+			}
+		}
+		if n := atomic.LoadInt32(&calls); (n > 0) != tt.serverSees {
+			t.Errorf("policy %d: server received %d calls", tt.policy, n)
+		}
+	}
+}
+
+func TestUnary_MethodBindingMismatch(t *testing.T) {
+	srv, addr, errChan := newTestServer(0)
+	if srv == nil {
+		t.Fatal("could not create grpc server")
+	}
+
+	// Attach a token bound to a different method than the one being called.
+	ci := newClientInterceptor("", "testuser1")
+	mismatch := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		tkn, err := ci.newToken(ctx, ci.tickets(), nil, cc.Target(), "/Service/Mirror", false, nil)
+		if err != nil {
+			return err
+		}
+		ctx = metadata.AppendToOutgoingContext(ctx, MDField, tkn.value)
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	conn, err := grpc.Dial(addr.String(), grpc.WithInsecure(), grpc.WithDisableRetry(), grpc.WithUnaryInterceptor(mismatch))
+	if err != nil {
+		t.Fatalf("could not create client connection: %v", err)
+	}
+	defer conn.Close()
+	_, err = test.NewServiceClient(conn).Reflector(context.Background(), &test.Request{RequestInt: 1})
+	if status.Code(err) != codes.Unauthenticated || ErrorReason(err) != ReasonMethodBinding {
+		t.Errorf("expected the token bound to another method to be rejected with the METHOD_BINDING reason, got: %v", err)
+	}
+	go srv.GracefulStop()
+	for err := range errChan {
+		if err != nil {
+			t.Errorf("error from grpc server: %v", err)
+		}
+	}
+}
+
+func TestUnary_UnboundToken(t *testing.T) {
+	var tests = []struct {
+		name   string
+		policy MethodBindingPolicy
+		code   codes.Code
+		reason string
+	}{
+		{"require", RequireMethodBinding, codes.Unauthenticated, ReasonMethodBinding},
+		{"allow unbound", AllowUnboundTokens, codes.OK, ""},
+	}
+	// attach a token from a legacy client without a method binding
+	ci := newClientInterceptor("", "testuser1")
+	defer ci.Close()
+	unbound := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		tkt, key, err := ci.getTicket(ctx, ci.tickets(), nil, false, ci.DefaultSPN)
+		if err != nil {
+			return err
+		}
+		auth, err := types.NewAuthenticator(ci.KRBClient.Credentials.Domain(), ci.KRBClient.Credentials.CName())
+		if err != nil {
+			return err
+		}
+		apReq, err := messages.NewAPReq(tkt, key, auth)
+		if err != nil {
+			return err
+		}
+		b, err := apReq.Marshal()
+		if err != nil {
+			return err
+		}
+		v, err := encodeAPReq(b, TokenFormatRaw)
+		if err != nil {
+			return err
+		}
+		return invoker(metadata.AppendToOutgoingContext(ctx, MDField, v), method, req, reply, cc, opts...)
+	}
+	for _, tt := range tests {
+		lis, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatalf("could not listen: %v", err)
+		}
+		si := NewKRBServerInterceptor(testKDC.Keytab("HTTP/host.test.gokrb5"), log.New(os.Stdout, "KRB: ", log.LstdFlags))
+		si.MethodBinding = tt.policy
+		srv := grpc.NewServer(grpc.UnaryInterceptor(si.Unary()))
+		test.RegisterServiceServer(srv, new(test.Server))
+		go srv.Serve(lis)
+
+		conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure(), grpc.WithDisableRetry(), grpc.WithUnaryInterceptor(unbound))
+		if err != nil {
+			t.Fatalf("could not create client connection: %v", err)
+		}
+		_, err = test.NewServiceClient(conn).Reflector(context.Background(), &test.Request{RequestInt: 1})
+		if status.Code(err) != tt.code || ErrorReason(err) != tt.reason {
+			t.Errorf("%s: unexpected error for unbound token: %v", tt.name, err)
+		}
+		conn.Close()
+		srv.Stop()
+	}
+}
+
+func TestUnary_Replay(t *testing.T) {
+	srv, addr, _ := newTestServer(0)
+	if srv == nil {
+		t.Fatal("could not create grpc server")
+	}
+	defer srv.Stop()
+
+	// attach the same token to every call
+	ci := newClientInterceptor("", "testuser1")
+	defer ci.Close()
+	var value string
+	replay := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if value == "" {
+			tkn, err := ci.newToken(ctx, ci.tickets(), nil, cc.Target(), method, false, nil)
+			if err != nil {
+				return err
+			}
+			value = tkn.value
+		}
+		return invoker(metadata.AppendToOutgoingContext(ctx, MDField, value), method, req, reply, cc, opts...)
+	}
+	conn, err := grpc.Dial(addr.String(), grpc.WithInsecure(), grpc.WithDisableRetry(), grpc.WithUnaryInterceptor(replay))
+	if err != nil {
+		t.Fatalf("could not create client connection: %v", err)
+	}
+	defer conn.Close()
+	client := test.NewServiceClient(conn)
+	if _, err := client.Reflector(context.Background(), &test.Request{RequestInt: 1}); err != nil {
+		t.Fatalf("first call with the token failed: %v", err)
+	}
+	_, err = client.Reflector(context.Background(), &test.Request{RequestInt: 1})
+	if status.Code(err) != codes.Unauthenticated || ErrorReason(err) != ReasonReplay {
+		t.Errorf("expected the replayed token to be rejected with the REPLAY reason, got: %v", err)
+	}
+}
+
+func TestUnary_AcceptedSPNs(t *testing.T) {
+	// one keytab holding the keys for two services
+	kt, err := testKDC.AddPrincipal("GRPC/svc-a.test.gokrb5")
+	if err != nil {
+		t.Fatalf("could not add principal: %v", err)
+	}
+	ktb, err := testKDC.AddPrincipal("GRPC/svc-b.test.gokrb5")
+	if err != nil {
+		t.Fatalf("could not add principal: %v", err)
+	}
+	kt.Entries = append(kt.Entries, ktb.Entries...)
+
+	var tests = []struct {
+		name           string
+		accepted       []string
+		checkAuthority bool
+		spn            string
+		reason         string
+	}{
+		{"any principal in keytab", nil, false, "GRPC/svc-b.test.gokrb5", ""},
+		{"accepted SPN", []string{"GRPC/svc-a.test.gokrb5"}, false, "GRPC/svc-a.test.gokrb5", ""},
+		{"accepted SPN with realm", []string{"GRPC/svc-a.test.gokrb5@TEST.GOKRB5"}, false, "GRPC/svc-a.test.gokrb5", ""},
+		{"SPN not accepted", []string{"GRPC/svc-a.test.gokrb5"}, false, "GRPC/svc-b.test.gokrb5", ReasonWrongSPN},
+		{"SPN matches authority", nil, true, "GRPC/svc-a.test.gokrb5", ""},
+		{"SPN for another authority", nil, true, "GRPC/svc-b.test.gokrb5", ReasonWrongSPN},
+	}
+	for _, tt := range tests {
+		si := NewKRBServerInterceptor(kt, log.New(os.Stdout, "KRB: ", log.LstdFlags))
+		si.AcceptedSPNs = tt.accepted
+		si.CheckAuthority = tt.checkAuthority
+		lis, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatalf("could not listen: %v", err)
+		}
+		srv := grpc.NewServer(grpc.UnaryInterceptor(si.Unary()))
+		test.RegisterServiceServer(srv, new(test.Server))
+		go srv.Serve(lis)
+
+		ci := newClientInterceptor(tt.spn, "testuser1")
+		conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure(), grpc.WithDisableRetry(),
+			grpc.WithAuthority("svc-a.test.gokrb5:8443"), grpc.WithUnaryInterceptor(ci.Unary()))
+		if err != nil {
+			t.Fatalf("could not create client connection: %v", err)
+		}
+		_, err = test.NewServiceClient(conn).Reflector(context.Background(), &test.Request{RequestInt: 1})
+		if tt.reason == "" && err != nil {
+			t.Errorf("%s: call should have succeeded: %v", tt.name, err)
+		}
+		if tt.reason != "" && ErrorReason(err) != tt.reason {
+			t.Errorf("%s: expected the call to fail with reason %s, got: %v", tt.name, tt.reason, err)
+		}
+		conn.Close()
+		ci.Close()
+		srv.Stop()
+	}
+}
+
+// newUnreachableKDCInterceptor returns a client interceptor configured with a KDC address nothing is listening on.
+func newUnreachableKDCInterceptor(t *testing.T) *KRBClientInterceptor {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not reserve a port: %v", err)
+	}
+	kdcAddr := lis.Addr().String()
+	lis.Close()
+	ci := newClientInterceptor("", "testuser1")
+	ci.KRBClient.Config.Realms[0].KDC = []string{kdcAddr}
+	return ci
+}
+
+// newStalledKDCInterceptor returns a client interceptor configured with a KDC that accepts connections but never replies.
+func newStalledKDCInterceptor(t *testing.T) *KRBClientInterceptor {
+	ci := newClientInterceptor("", "testuser1")
+	ci.KRBClient.Config.Realms[0].KDC = []string{newStalledKDC(t)}
+	return ci
+}
+
+// newStalledKDC returns the address of a KDC that accepts connections but never replies.
+func newStalledKDC(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not start stalled KDC: %v", err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				for _, c := range conns {
+					c.Close()
+				}
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	return lis.Addr().String()
+}
+
+func connect(addr, spn, username string) (*grpc.ClientConn, error) {
+	return connectWithInterceptor(addr, newClientInterceptor(spn, username))
+}
+
+func connectWithInterceptor(addr string, ci *KRBClientInterceptor) (*grpc.ClientConn, error) {
 	opts := []grpc.DialOption{grpc.WithInsecure(), grpc.WithDisableRetry(),
 		grpc.WithUnaryInterceptor(ci.Unary()),
 		grpc.WithStreamInterceptor(ci.Stream())}
 	return grpc.Dial(addr, opts...)
 }
 
-func sendUnaryMessage(addr, spn, username, ktHex string) (*test.Response, error) {
+func sendUnaryMessage(addr, spn, username string) (*test.Response, error) {
+	return sendUnaryMessageWithInterceptor(addr, newClientInterceptor(spn, username))
+}
+
+func sendUnaryMessageWithInterceptor(addr string, ci *KRBClientInterceptor) (*test.Response, error) {
 	req := &test.Request{
 		RequestInt: 123,
 		RequestStr: "hello world",
 	}
-	conn, err := connect(addr, spn, username, ktHex)
+	conn, err := connectWithInterceptor(addr, ci)
 	if err != nil {
 		return nil, err
 	}
@@ -309,10 +876,11 @@ func sendUnaryMessage(addr, spn, username, ktHex string) (*test.Response, error)
 }
 
 // newTestServer returns a test grpc server.
+// Any server options provided are added after the Kerberos interceptors.
 // Check that the *grpc.Server is not nil before use.
 // The error channel will return errors from the grpc server's Serve() method
 // If the port is specified as zero one is auto allocated and can be discovered from the net.Addr returned
-func newTestServer(port int) (*grpc.Server, net.Addr, <-chan error) {
+func newTestServer(port int, opt ...grpc.ServerOption) (*grpc.Server, net.Addr, <-chan error) {
 	errs := make(chan error, 1)
 	s := new(test.Server)
 
@@ -321,9 +889,7 @@ func newTestServer(port int) (*grpc.Server, net.Addr, <-chan error) {
 		return nil, nil, errs
 	}
 
-	b, _ := hex.DecodeString(serviceKeytab)
-	kt := keytab.New()
-	kt.Unmarshal(b)
+	kt := testKDC.Keytab("HTTP/host.test.gokrb5")
 	l := log.New(os.Stdout, "KRB: ", log.LstdFlags)
 	authzRoles := make(map[string][]string)
 	authzRoles["/Service/Reflector"] = []string{"testuser1@TEST.GOKRB5"}
@@ -338,7 +904,7 @@ func newTestServer(port int) (*grpc.Server, net.Addr, <-chan error) {
 		grpc.UnaryInterceptor(si.Unary()),
 		grpc.StreamInterceptor(si.Stream()),
 	}
-	grpcSrv := grpc.NewServer(opts...)
+	grpcSrv := grpc.NewServer(append(opts, opt...)...)
 
 	test.RegisterServiceServer(grpcSrv, s)
 	go func() {
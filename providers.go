@@ -0,0 +1,222 @@
+package grpc_krb
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+)
+
+// KeytabProvider loads a keytab from wherever it is kept.
+type KeytabProvider interface {
+	LoadKeytab(ctx context.Context) (*keytab.Keytab, error)
+}
+
+// ClientCredentialProvider creates the Kerberos client used by the client interceptor.
+type ClientCredentialProvider interface {
+	NewClient(ctx context.Context) (*client.Client, error)
+}
+
+var (
+	// DefaultServiceKeytab loads the keytab named by the KRB5_KTNAME environment variable, as MIT Kerberos services do.
+	DefaultServiceKeytab KeytabProvider = KeytabPathEnv("KRB5_KTNAME")
+	// DefaultClientKeytab loads the keytab named by the KRB5_CLIENT_KTNAME environment variable, as MIT Kerberos clients do.
+	DefaultClientKeytab KeytabProvider = KeytabPathEnv("KRB5_CLIENT_KTNAME")
+)
+
+// KeytabFile loads the keytab from the file at this path.
+type KeytabFile string
+
+func (p KeytabFile) LoadKeytab(ctx context.Context) (*keytab.Keytab, error) {
+	kt, err := keytab.Load(string(p))
+	if err != nil {
+		return nil, fmt.Errorf("could not load keytab %s: %v", string(p), err)
+	}
+	return kt, nil
+}
+
+// KeytabPathEnv loads the keytab from the file named by this environment variable.
+// The name may have the FILE: prefix used by MIT Kerberos, other keytab types are not supported.
+type KeytabPathEnv string
+
+func (p KeytabPathEnv) LoadKeytab(ctx context.Context) (*keytab.Keytab, error) {
+	name := os.Getenv(string(p))
+	if name == "" {
+		return nil, fmt.Errorf("environment variable %s is not set", string(p))
+	}
+	if n := strings.Index(name, ":"); n > 1 {
+		if !strings.EqualFold(name[:n], "FILE") {
+			return nil, fmt.Errorf("keytab %s from %s is not a file", name, string(p))
+		}
+		name = name[n+1:]
+	}
+	return KeytabFile(name).LoadKeytab(ctx)
+}
+
+// KeytabBase64Env loads the keytab from the base64 encoded content of this environment variable,
+// so a keytab injected from a secrets manager is never written to disk.
+type KeytabBase64Env string
+
+func (p KeytabBase64Env) LoadKeytab(ctx context.Context) (*keytab.Keytab, error) {
+	v := os.Getenv(string(p))
+	if v == "" {
+		return nil, fmt.Errorf("environment variable %s is not set", string(p))
+	}
+	return unmarshalBase64Keytab(v)
+}
+
+// HTTPKeytab fetches the keytab from a secret store over HTTP with a GET request.
+// The response body is the keytab itself, unless Field is set.
+type HTTPKeytab struct {
+	URL string
+	// Header is added to the request, for example to carry the token authenticating to the secret store.
+	Header http.Header
+	// Field is the dot separated path to the base64 encoded keytab in a JSON response, such as data.data.keytab for a Vault KV secret.
+	Field string
+	// Client makes the request. Defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+func (p *HTTPKeytab) LoadKeytab(ctx context.Context) (*keytab.Keytab, error) {
+	req, err := http.NewRequest(http.MethodGet, p.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range p.Header {
+		req.Header[k] = v
+	}
+	hc := p.Client
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch keytab: %v", err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch keytab: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not fetch keytab: secret store returned %s", resp.Status)
+	}
+	if p.Field == "" {
+		kt := keytab.New()
+		if err := kt.Unmarshal(b); err != nil {
+			return nil, fmt.Errorf("could not unmarshal keytab: %v", err)
+		}
+		return kt, nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, fmt.Errorf("could not decode secret store response: %v", err)
+	}
+	for _, f := range strings.Split(p.Field, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			v = nil
+			break
+		}
+		v = m[f]
+	}
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("secret store response has no string field %s", p.Field)
+	}
+	return unmarshalBase64Keytab(s)
+}
+
+func unmarshalBase64Keytab(s string) (*keytab.Keytab, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode base64 keytab: %v", err)
+	}
+	kt := keytab.New()
+	if err := kt.Unmarshal(b); err != nil {
+		return nil, fmt.Errorf("could not unmarshal keytab: %v", err)
+	}
+	return kt, nil
+}
+
+// KeytabClient creates a client that logs in with a key for the user from a keytab.
+type KeytabClient struct {
+	Username string
+	// Realm defaults to the default_realm of the configuration.
+	Realm string
+	// Keytab defaults to DefaultClientKeytab.
+	Keytab KeytabProvider
+	// Config defaults to the krb5.conf named by the KRB5_CONFIG environment variable, or /etc/krb5.conf.
+	Config *config.Config
+	// Settings are applied to the client created.
+	Settings []func(*client.Settings)
+}
+
+func (p *KeytabClient) NewClient(ctx context.Context) (*client.Client, error) {
+	if p.Username == "" {
+		return nil, errors.New("no username for the client")
+	}
+	cfg := p.Config
+	if cfg == nil {
+		var err error
+		cfg, err = loadConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+	realm := p.Realm
+	if realm == "" {
+		realm = cfg.LibDefaults.DefaultRealm
+	}
+	ktp := p.Keytab
+	if ktp == nil {
+		ktp = DefaultClientKeytab
+	}
+	kt, err := ktp.LoadKeytab(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return client.NewWithKeytab(p.Username, realm, kt, cfg, p.Settings...), nil
+}
+
+// loadConfig loads the krb5.conf named by the KRB5_CONFIG environment variable, or /etc/krb5.conf.
+func loadConfig() (*config.Config, error) {
+	path := os.Getenv("KRB5_CONFIG")
+	if path == "" {
+		path = "/etc/krb5.conf"
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not load kerberos configuration %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// NewKRBServerInterceptorFromProvider returns a server interceptor using the keytab loaded from the provider.
+func NewKRBServerInterceptorFromProvider(ctx context.Context, p KeytabProvider, logger *log.Logger) (*KRBServerInterceptor, error) {
+	kt, err := p.LoadKeytab(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewKRBServerInterceptor(kt, logger), nil
+}
+
+// NewKRBClientInterceptorFromProvider returns a client interceptor using the client created by the provider.
+func NewKRBClientInterceptorFromProvider(ctx context.Context, p ClientCredentialProvider) (*KRBClientInterceptor, error) {
+	cl, err := p.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &KRBClientInterceptor{KRBClient: cl}, nil
+}
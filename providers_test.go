@@ -0,0 +1,147 @@
+package grpc_krb
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jcmturner/grpckrb/test"
+	"google.golang.org/grpc"
+)
+
+func TestKeytabProviders(t *testing.T) {
+	kt := testKDC.Keytab("HTTP/host.test.gokrb5")
+	b, err := kt.Marshal()
+	if err != nil {
+		t.Fatalf("could not marshal keytab: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "grpckrb")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "service.keytab")
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatalf("could not write keytab: %v", err)
+	}
+	b64 := base64.StdEncoding.EncodeToString(b)
+
+	os.Setenv("GRPCKRB_TEST_KTNAME", "FILE:"+path)
+	defer os.Unsetenv("GRPCKRB_TEST_KTNAME")
+	os.Setenv("GRPCKRB_TEST_KEYTAB", b64)
+	defer os.Unsetenv("GRPCKRB_TEST_KEYTAB")
+
+	// a secret store returning the keytab itself or within a JSON document, requiring a token
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s3cr3t" {
+			http.Error(w, "permission denied", http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/raw":
+			w.Write(b)
+		case "/kv":
+			fmt.Fprintf(w, `{"data":{"data":{"keytab":%q}}}`, b64)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer store.Close()
+	header := http.Header{"X-Vault-Token": []string{"s3cr3t"}}
+
+	var tests = []struct {
+		name string
+		p    KeytabProvider
+	}{
+		{"file", KeytabFile(path)},
+		{"path env", KeytabPathEnv("GRPCKRB_TEST_KTNAME")},
+		{"base64 env", KeytabBase64Env("GRPCKRB_TEST_KEYTAB")},
+		{"http", &HTTPKeytab{URL: store.URL + "/raw", Header: header}},
+		{"http json", &HTTPKeytab{URL: store.URL + "/kv", Header: header, Field: "data.data.keytab"}},
+	}
+	for _, tt := range tests {
+		got, err := tt.p.LoadKeytab(context.Background())
+		if err != nil {
+			t.Errorf("%s: could not load keytab: %v", tt.name, err)
+			continue
+		}
+		if len(got.Entries) != len(kt.Entries) || got.Entries[0].Principal.String() != kt.Entries[0].Principal.String() {
+			t.Errorf("%s: loaded keytab does not match", tt.name)
+		}
+	}
+
+	var failures = []struct {
+		name string
+		p    KeytabProvider
+	}{
+		{"missing file", KeytabFile(filepath.Join(dir, "missing.keytab"))},
+		{"unset env", KeytabPathEnv("GRPCKRB_TEST_UNSET")},
+		{"not a file", KeytabPathEnv("GRPCKRB_TEST_KEYTAB")},
+		{"http unauthorized", &HTTPKeytab{URL: store.URL + "/raw"}},
+		{"http missing field", &HTTPKeytab{URL: store.URL + "/kv", Header: header, Field: "data.keytab"}},
+	}
+	for _, tt := range failures {
+		if _, err := tt.p.LoadKeytab(context.Background()); err == nil {
+			t.Errorf("%s: expected an error loading the keytab", tt.name)
+		}
+	}
+}
+
+func TestProviderInterceptors(t *testing.T) {
+	b, err := testKDC.Keytab("HTTP/host.test.gokrb5").Marshal()
+	if err != nil {
+		t.Fatalf("could not marshal keytab: %v", err)
+	}
+	os.Setenv("GRPCKRB_TEST_SERVICE_KEYTAB", base64.StdEncoding.EncodeToString(b))
+	defer os.Unsetenv("GRPCKRB_TEST_SERVICE_KEYTAB")
+	b, err = testKDC.Keytab("testuser1").Marshal()
+	if err != nil {
+		t.Fatalf("could not marshal keytab: %v", err)
+	}
+	os.Setenv("GRPCKRB_TEST_CLIENT_KEYTAB", base64.StdEncoding.EncodeToString(b))
+	defer os.Unsetenv("GRPCKRB_TEST_CLIENT_KEYTAB")
+
+	si, err := NewKRBServerInterceptorFromProvider(context.Background(), KeytabBase64Env("GRPCKRB_TEST_SERVICE_KEYTAB"), log.New(os.Stdout, "KRB: ", log.LstdFlags))
+	if err != nil {
+		t.Fatalf("could not create server interceptor: %v", err)
+	}
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	srv := grpc.NewServer(grpc.UnaryInterceptor(si.Unary()))
+	test.RegisterServiceServer(srv, new(test.Server))
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	cfg, err := testKDC.Config()
+	if err != nil {
+		t.Fatalf("could not get KDC config: %v", err)
+	}
+	ci, err := NewKRBClientInterceptorFromProvider(context.Background(), &KeytabClient{
+		Username: "testuser1",
+		Keytab:   KeytabBase64Env("GRPCKRB_TEST_CLIENT_KEYTAB"),
+		Config:   cfg,
+	})
+	if err != nil {
+		t.Fatalf("could not create client interceptor: %v", err)
+	}
+	defer ci.Close()
+	ci.DefaultSPN = "HTTP/host.test.gokrb5"
+	if _, err := sendUnaryMessageWithInterceptor(lis.Addr().String(), ci); err != nil {
+		t.Errorf("call with credentials from providers failed: %v", err)
+	}
+
+	_, err = (&KeytabClient{Username: "testuser1", Keytab: KeytabBase64Env("GRPCKRB_TEST_UNSET"), Config: cfg}).NewClient(context.Background())
+	if err == nil {
+		t.Error("expected an error creating a client without a keytab")
+	}
+}
@@ -0,0 +1,85 @@
+package grpc_krb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"google.golang.org/grpc/codes"
+)
+
+// maxReferrals limits the number of KDCs followed to obtain a TGT for another realm.
+const maxReferrals = 5
+
+// spnRealm returns the realm of a host based SPN from the [domain_realm] mapping of its host in krb5.conf,
+// or the client's realm if the host is not mapped. The client's KDC may still refer it on to another realm.
+func (c *ticketCache) spnRealm(princ types.PrincipalName) string {
+	realm := c.cl.Credentials.Domain()
+	if len(princ.NameString) < 2 || c.cl.Config == nil {
+		return realm
+	}
+	host := strings.ToLower(strings.TrimSuffix(princ.NameString[1], "."))
+	dr := c.cl.Config.DomainRealm
+	if r, ok := dr[host]; ok {
+		return r
+	}
+	// the longest domain of the host that is mapped applies
+	for n := strings.Index(host, "."); n >= 0; n = strings.Index(host, ".") {
+		if r, ok := dr[host[n:]]; ok {
+			return r
+		}
+		host = host[n+1:]
+	}
+	return realm
+}
+
+// crossRealmTGT returns a TGT for another realm, cached until it is due for renewal.
+func (c *ticketCache) crossRealmTGT(realm string) (*cachedTicket, error) {
+	return c.lookup(context.Background(), "TGT for "+realm, func() (*cachedTicket, error) {
+		return c.fetchCrossRealmTGT(realm)
+	})
+}
+
+// fetchCrossRealmTGT obtains a TGT for another realm starting from the client's KDC. A KDC without a direct trust
+// with the realm refers the client to one on the path to it with a TGT for that realm's KDC, which is asked in turn.
+func (c *ticketCache) fetchCrossRealmTGT(realm string) (*cachedTicket, error) {
+	tgt, err := c.getTGT()
+	if err != nil {
+		return nil, err
+	}
+	sname := types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt/"+realm)
+	tkt, key, kdcRealm := tgt.tkt, tgt.key, c.cl.Credentials.Domain()
+	for n := 0; n < maxReferrals; n++ {
+		req, err := newTGSReq(c.cl, tkt, key, sname, kdcRealm, nil)
+		if err != nil {
+			return nil, err
+		}
+		rep, err := sendTGSReq(c.cl, req, kdcRealm, key)
+		if err != nil {
+			if strings.Contains(err.Error(), "KDC_ERR_S_PRINCIPAL_UNKNOWN") {
+				return nil, authError(codes.Unauthenticated, ReasonKDCError, "no trust path from realm %s to %s: %v", kdcRealm, realm, err)
+			}
+			return nil, err
+		}
+		if rep.Ticket.SName.Equal(sname) {
+			return newCachedTicket(rep.Ticket, rep.DecryptedEncPart), nil
+		}
+		next, ok := referralRealm(rep.Ticket)
+		if !ok || next == kdcRealm {
+			return nil, fmt.Errorf("KDC for %s issued a ticket for %s when asked for %s", kdcRealm, rep.Ticket.SName.PrincipalNameString(), sname.PrincipalNameString())
+		}
+		tkt, key, kdcRealm = rep.Ticket, rep.DecryptedEncPart.Key, next
+	}
+	return nil, fmt.Errorf("more than %d referrals obtaining a TGT for realm %s", maxReferrals, realm)
+}
+
+// referralRealm returns the realm a referral TGT is for.
+func referralRealm(tkt messages.Ticket) (string, bool) {
+	if len(tkt.SName.NameString) != 2 || tkt.SName.NameString[0] != "krbtgt" {
+		return "", false
+	}
+	return tkt.SName.NameString[1], true
+}
@@ -0,0 +1,139 @@
+package grpc_krb
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/jcmturner/grpckrb/kdctest"
+	"github.com/jcmturner/grpckrb/test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestCrossRealm(t *testing.T) {
+	// HOME trusts MIDDLE which trusts PARTNER, so HOME's KDC refers clients to MIDDLE for PARTNER
+	kdcs := make(map[string]*kdctest.KDC)
+	for _, realm := range []string{"HOME.GOKRB5", "MIDDLE.GOKRB5", "PARTNER.GOKRB5"} {
+		k, err := kdctest.New(realm)
+		if err != nil {
+			t.Fatalf("could not start KDC: %v", err)
+		}
+		defer k.Close()
+		kdcs[realm] = k
+	}
+	if err := kdcs["HOME.GOKRB5"].Trust(kdcs["MIDDLE.GOKRB5"], "middle.example"); err != nil {
+		t.Fatalf("could not set up trust: %v", err)
+	}
+	if err := kdcs["MIDDLE.GOKRB5"].Trust(kdcs["PARTNER.GOKRB5"]); err != nil {
+		t.Fatalf("could not set up trust: %v", err)
+	}
+
+	serve := func(realm, spn string, allowed ...string) string {
+		kt, err := kdcs[realm].AddPrincipal(spn)
+		if err != nil {
+			t.Fatalf("could not add principal %s: %v", spn, err)
+		}
+		lis, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatalf("could not listen: %v", err)
+		}
+		si := &KRBServerInterceptor{
+			Settings:      service.NewSettings(kt, service.Logger(log.New(os.Stdout, "KRB: ", log.LstdFlags))),
+			AllowedRealms: allowed,
+		}
+		s := grpc.NewServer(grpc.UnaryInterceptor(si.Unary()))
+		test.RegisterServiceServer(s, new(test.Server))
+		go s.Serve(lis)
+		t.Cleanup(s.Stop)
+		return lis.Addr().String()
+	}
+	call := func(addr, spn string) error {
+		cl, err := kdcs["HOME.GOKRB5"].NewClient("testuser1")
+		if err != nil {
+			t.Fatalf("could not create client: %v", err)
+		}
+		ci := &KRBClientInterceptor{KRBClient: cl, DefaultSPN: spn}
+		defer ci.Close()
+		_, err = sendUnaryMessageWithInterceptor(addr, ci)
+		return err
+	}
+
+	// the realm is found from the [domain_realm] mapping of the host in krb5.conf and reached through MIDDLE
+	addr := serve("PARTNER.GOKRB5", "GRPC/host.partner.gokrb5", "HOME.GOKRB5")
+	if err := call(addr, "GRPC/host.partner.gokrb5"); err != nil {
+		t.Errorf("call to service in a partner realm failed: %v", err)
+	}
+	if kdcs["MIDDLE.GOKRB5"].Requests() == 0 {
+		t.Error("expected the client to be referred to the KDC of MIDDLE.GOKRB5")
+	}
+	// the host is not mapped so the home KDC refers the client to the service's realm
+	addr = serve("MIDDLE.GOKRB5", "GRPC/host.middle.example")
+	if err := call(addr, "GRPC/host.middle.example"); err != nil {
+		t.Errorf("call to service found by referral failed: %v", err)
+	}
+	addr = serve("PARTNER.GOKRB5", "GRPC/other.partner.gokrb5", "PARTNER.GOKRB5")
+	if err := call(addr, "GRPC/other.partner.gokrb5"); ErrorReason(err) != ReasonUntrustedRealm {
+		t.Errorf("expected caller from a realm not allowed to be rejected, got: %v", err)
+	}
+}
+
+func TestForgedClientRealm(t *testing.T) {
+	kt := testKDC.Keytab("HTTP/host.test.gokrb5")
+	si := &KRBServerInterceptor{
+		Settings:      service.NewSettings(kt, service.Logger(log.New(os.Stdout, "KRB: ", log.LstdFlags))),
+		AllowedRealms: []string{"TRUSTED.GOKRB5"},
+	}
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	srv := grpc.NewServer(grpc.UnaryInterceptor(si.Unary()))
+	test.RegisterServiceServer(srv, new(test.Server))
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	// the authenticator claims a trusted realm the ticket from the KDC does not have
+	ci := newClientInterceptor("", "testuser1")
+	defer ci.Close()
+	forge := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		tkt, key, err := ci.getTicket(ctx, ci.tickets(), nil, false, ci.DefaultSPN)
+		if err != nil {
+			return err
+		}
+		auth, err := types.NewAuthenticator("TRUSTED.GOKRB5", ci.KRBClient.Credentials.CName())
+		if err != nil {
+			return err
+		}
+		auth.Cksum = types.Checksum{CksumType: methodBindingCksumType, Checksum: []byte(method)}
+		apReq, err := messages.NewAPReq(tkt, key, auth)
+		if err != nil {
+			return err
+		}
+		b, err := apReq.Marshal()
+		if err != nil {
+			return err
+		}
+		v, err := encodeAPReq(b, TokenFormatRaw)
+		if err != nil {
+			return err
+		}
+		return invoker(metadata.AppendToOutgoingContext(ctx, MDField, v), method, req, reply, cc, opts...)
+	}
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure(), grpc.WithDisableRetry(), grpc.WithUnaryInterceptor(forge))
+	if err != nil {
+		t.Fatalf("could not create client connection: %v", err)
+	}
+	defer conn.Close()
+	_, err = test.NewServiceClient(conn).Reflector(context.Background(), &test.Request{RequestInt: 1})
+	if status.Code(err) != codes.Unauthenticated || ErrorReason(err) != ReasonInvalidToken {
+		t.Errorf("expected the forged client realm to be rejected as an invalid token, got: %v", err)
+	}
+}
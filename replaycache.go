@@ -0,0 +1,211 @@
+package grpc_krb
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReplayKey identifies an authenticator presented to a service.
+type ReplayKey struct {
+	CName string
+	CTime time.Time
+	Cusec int
+	SName string
+}
+
+func (k ReplayKey) String() string {
+	return fmt.Sprintf("%s|%d|%d|%s", k.CName, k.CTime.Unix(), k.Cusec, k.SName)
+}
+
+// ReplayCache records the authenticators presented to a service so that replays can be detected.
+// Implementations shared between server instances stop a token accepted by one instance being replayed against another.
+type ReplayCache interface {
+	// IsReplay reports if the key has already been recorded within the ttl. If not the key is recorded.
+	IsReplay(ctx context.Context, key ReplayKey, ttl time.Duration) (bool, error)
+}
+
+// replayTTL returns how long an authenticator must be recorded for. It is accepted until its ctime plus the clock skew,
+// and its ctime may be up to the clock skew ahead, so it is recorded until then and for at least the clock skew.
+func replayTTL(ctime time.Time, skew time.Duration) time.Duration {
+	if ttl := time.Until(ctime.Add(skew)); ttl > skew {
+		return ttl
+	}
+	return skew
+}
+
+// MemoryReplayCache is an in process ReplayCache. Entries are spread over a number of shards to reduce lock contention.
+type MemoryReplayCache struct {
+	shards []*replayShard
+}
+
+type replayShard struct {
+	mux       sync.Mutex
+	entries   map[string]time.Time
+	nextSweep time.Time
+}
+
+// NewMemoryReplayCache returns a new MemoryReplayCache with the number of shards specified.
+func NewMemoryReplayCache(shards int) *MemoryReplayCache {
+	if shards < 1 {
+		shards = 1
+	}
+	c := &MemoryReplayCache{
+		shards: make([]*replayShard, shards),
+	}
+	for n := range c.shards {
+		c.shards[n] = &replayShard{
+			entries: make(map[string]time.Time),
+		}
+	}
+	return c
+}
+
+func (c *MemoryReplayCache) IsReplay(ctx context.Context, key ReplayKey, ttl time.Duration) (bool, error) {
+	k := key.String()
+	h := fnv.New32a()
+	h.Write([]byte(k))
+	s := c.shards[h.Sum32()%uint32(len(c.shards))]
+
+	now := time.Now()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if now.After(s.nextSweep) {
+		for e, exp := range s.entries {
+			if now.After(exp) {
+				delete(s.entries, e)
+			}
+		}
+		s.nextSweep = now.Add(ttl)
+	}
+	if exp, ok := s.entries[k]; ok && now.Before(exp) {
+		return true, nil
+	}
+	s.entries[k] = now.Add(ttl)
+	return false, nil
+}
+
+// NetworkReplayCache is a ReplayCache backed by a key/value server speaking the Redis protocol.
+// Entries are written with SET NX and expire after the ttl.
+type NetworkReplayCache struct {
+	Addr    string
+	Prefix  string
+	Timeout time.Duration
+	MaxIdle int
+
+	mux  sync.Mutex
+	idle []*replayConn
+}
+
+type replayConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *NetworkReplayCache) IsReplay(ctx context.Context, key ReplayKey, ttl time.Duration) (bool, error) {
+	conn, err := c.conn(ctx)
+	if err != nil {
+		return false, fmt.Errorf("could not connect to replay cache: %v", err)
+	}
+	deadline := time.Now().Add(c.timeout())
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	ms := ttl.Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	replay, err := conn.setNX(c.Prefix+key.String(), strconv.FormatInt(ms, 10))
+	if err != nil {
+		conn.Close()
+		return false, fmt.Errorf("replay cache error: %v", err)
+	}
+	c.release(conn)
+	return replay, nil
+}
+
+// setNX sends SET key 1 NX PX ms and reports if the key already existed.
+func (conn *replayConn) setNX(k, ms string) (bool, error) {
+	args := []string{"SET", k, "1", "NX", "PX", ms}
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	_, err := conn.Write([]byte(b.String()))
+	if err != nil {
+		return false, err
+	}
+	line, err := conn.r.ReadString('\n')
+	if err != nil {
+		return false, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	switch {
+	case line == "+OK":
+		return false, nil
+	case line == "$-1" || line == "*-1":
+		return true, nil
+	case strings.HasPrefix(line, "-"):
+		return false, errors.New(line[1:])
+	}
+	return false, fmt.Errorf("unexpected reply %q", line)
+}
+
+func (c *NetworkReplayCache) conn(ctx context.Context) (*replayConn, error) {
+	c.mux.Lock()
+	if n := len(c.idle); n > 0 {
+		conn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mux.Unlock()
+		return conn, nil
+	}
+	c.mux.Unlock()
+	d := net.Dialer{Timeout: c.timeout()}
+	conn, err := d.DialContext(ctx, "tcp", c.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return &replayConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func (c *NetworkReplayCache) release(conn *replayConn) {
+	max := c.MaxIdle
+	if max < 1 {
+		max = 4
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if len(c.idle) >= max {
+		conn.Close()
+		return
+	}
+	c.idle = append(c.idle, conn)
+}
+
+func (c *NetworkReplayCache) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return 2 * time.Second
+}
+
+// Close closes any idle connections to the key/value server.
+func (c *NetworkReplayCache) Close() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for _, conn := range c.idle {
+		conn.Close()
+	}
+	c.idle = nil
+	return nil
+}
@@ -0,0 +1,169 @@
+package grpc_krb
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryReplayCache(t *testing.T) {
+	testReplayCache(t, NewMemoryReplayCache(4))
+}
+
+func TestNetworkReplayCache(t *testing.T) {
+	addr, stop := newTestKVServer(t)
+	defer stop()
+	c := &NetworkReplayCache{Addr: addr, Prefix: "grpckrb:"}
+	defer c.Close()
+	testReplayCache(t, c)
+}
+
+func TestNetworkReplayCache_Shared(t *testing.T) {
+	addr, stop := newTestKVServer(t)
+	defer stop()
+	a := &NetworkReplayCache{Addr: addr}
+	defer a.Close()
+	b := &NetworkReplayCache{Addr: addr}
+	defer b.Close()
+
+	key := ReplayKey{CName: "testuser1@TEST.GOKRB5", CTime: time.Now(), Cusec: 1, SName: "HTTP/host.test.gokrb5@TEST.GOKRB5"}
+	replay, err := a.IsReplay(context.Background(), key, time.Minute)
+	if err != nil || replay {
+		t.Fatalf("first use of key reported as replay: %v %v", replay, err)
+	}
+	replay, err = b.IsReplay(context.Background(), key, time.Minute)
+	if err != nil {
+		t.Fatalf("error checking replay: %v", err)
+	}
+	if !replay {
+		t.Error("replay against a second instance not detected")
+	}
+}
+
+func TestNetworkReplayCache_Unavailable(t *testing.T) {
+	addr, stop := newTestKVServer(t)
+	stop()
+	c := &NetworkReplayCache{Addr: addr, Timeout: time.Second}
+	key := ReplayKey{CName: "testuser1@TEST.GOKRB5", CTime: time.Now(), SName: "HTTP/host.test.gokrb5@TEST.GOKRB5"}
+	_, err := c.IsReplay(context.Background(), key, time.Minute)
+	if err == nil {
+		t.Error("expected an error when the key/value server is unavailable")
+	}
+}
+
+func TestReplayTTL(t *testing.T) {
+	skew := 5 * time.Minute
+	if ttl := replayTTL(time.Now().Add(-time.Minute), skew); ttl != skew {
+		t.Errorf("expected an authenticator from the past to be recorded for the clock skew, got %v", ttl)
+	}
+	// an authenticator from a client with a fast clock is accepted until its ctime plus the skew
+	if ttl := replayTTL(time.Now().Add(4*time.Minute), skew); ttl < 8*time.Minute || ttl > 9*time.Minute {
+		t.Errorf("expected an authenticator from the future to be recorded until its ctime plus the clock skew, got %v", ttl)
+	}
+}
+
+func testReplayCache(t *testing.T, rc ReplayCache) {
+	ctx := context.Background()
+	now := time.Now()
+	key := ReplayKey{CName: "testuser1@TEST.GOKRB5", CTime: now, Cusec: 123, SName: "HTTP/host.test.gokrb5@TEST.GOKRB5"}
+
+	replay, err := rc.IsReplay(ctx, key, 50*time.Millisecond)
+	if err != nil || replay {
+		t.Fatalf("first use of key reported as replay: %v %v", replay, err)
+	}
+	replay, err = rc.IsReplay(ctx, key, 50*time.Millisecond)
+	if err != nil || !replay {
+		t.Fatalf("second use of key not reported as replay: %v %v", replay, err)
+	}
+	other := key
+	other.SName = "GRPC/host.test.gokrb5@TEST.GOKRB5"
+	replay, err = rc.IsReplay(ctx, other, 50*time.Millisecond)
+	if err != nil || replay {
+		t.Fatalf("key for a different service reported as replay: %v %v", replay, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	replay, err = rc.IsReplay(ctx, key, 50*time.Millisecond)
+	if err != nil || replay {
+		t.Fatalf("key reported as replay after ttl expired: %v %v", replay, err)
+	}
+}
+
+// newTestKVServer starts a stand in for a Redis server that supports only SET with the NX and PX options.
+func newTestKVServer(t *testing.T) (string, func()) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("could not start key/value server: %v", err)
+	}
+	var mux sync.Mutex
+	store := make(map[string]time.Time)
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					args, err := readRESPArray(r)
+					if err != nil {
+						return
+					}
+					if len(args) != 6 || strings.ToUpper(args[0]) != "SET" {
+						fmt.Fprint(conn, "-ERR unsupported command\r\n")
+						continue
+					}
+					ms, _ := strconv.Atoi(args[5])
+					mux.Lock()
+					exp, ok := store[args[1]]
+					if ok && time.Now().Before(exp) {
+						mux.Unlock()
+						fmt.Fprint(conn, "$-1\r\n")
+						continue
+					}
+					store[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+					mux.Unlock()
+					fmt.Fprint(conn, "+OK\r\n")
+				}
+			}(conn)
+		}
+	}()
+	return lis.Addr().String(), func() { lis.Close() }
+}
+
+func readRESPArray(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		l, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, l+2)
+		_, err = io.ReadFull(r, b)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:l])
+	}
+	return args, nil
+}
@@ -1,30 +1,90 @@
 package grpc_krb
 
 import (
+	"bytes"
 	"context"
-	"encoding/base64"
 	"fmt"
 	"log"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/jcmturner/gofork/encoding/asn1"
 	"github.com/jcmturner/goidentity/v6"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/iana"
+	"github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
+	"github.com/jcmturner/gokrb5/v8/iana/chksumtype"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
 	"github.com/jcmturner/gokrb5/v8/keytab"
 	"github.com/jcmturner/gokrb5/v8/messages"
 	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/gokrb5/v8/types"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
-	"google.golang.org/grpc/status"
 )
 
 const (
-	MDField = "authorization"
+	MDField      = "authorization"
+	MDReplyField = "www-authenticate"
+)
+
+// MethodBindingPolicy defines how the server treats tokens that do not carry a binding to the GRPC method called.
+type MethodBindingPolicy int
+
+const (
+	// RequireMethodBinding rejects tokens that are not bound to the method being called.
+	RequireMethodBinding MethodBindingPolicy = iota
+	// AllowUnboundTokens accepts tokens from legacy clients that do not send a method binding.
+	// Tokens that do carry a binding must still match the method being called.
+	AllowUnboundTokens
 )
 
 type KRBServerInterceptor struct {
 	Settings           *service.Settings
 	AuthorizationRoles map[string][]string
 	AllowAnonymous     bool
+	MethodBinding      MethodBindingPolicy
+	// ReplayCache is used to detect replayed tokens. If nil an in memory cache local to the interceptor is used.
+	// Servers scaled horizontally should share a cache such as NetworkReplayCache.
+	ReplayCache ReplayCache
+	// KeytabSource provides the keytab used to verify tickets in place of the one in Settings,
+	// allowing keys to be rotated while the server is running. See FileKeytabSource.
+	KeytabSource KeytabSource
+	// AcceptedSPNs limits the service principals tickets are accepted for, given as GRPC/host.example.com or with the realm
+	// as GRPC/host.example.com@EXAMPLE.COM. If empty tickets for any principal with a key in the keytab are accepted.
+	AcceptedSPNs []string
+	// AllowedRealms limits the realms callers are accepted from, for servers trusting other realms through cross-realm TGTs.
+	// Callers from other realms are rejected before authorization. If empty callers from any realm are accepted.
+	AllowedRealms []string
+	// CheckAuthority requires the host of the ticket's service principal to match the host in the :authority of the call,
+	// so that a ticket obtained for one service cannot be sent to another sharing the keytab.
+	CheckAuthority bool
+	// ForwardedTGTMethods are the full method names that accept a TGT forwarded by the caller. It is made available to the
+	// handler as a client with ForwardedClientFromContext. TGTs forwarded to other methods are ignored.
+	ForwardedTGTMethods map[string]bool
+	// DenyProtocolTransitionMethods are the full method names that refuse callers whose ticket a service obtained for them
+	// with S4U2Self, rather than the caller authenticating to the KDC. See Principal.ProtocolTransition.
+	// Only a verified PAC can show the caller authenticated to the KDC, so these methods also refuse callers whose ticket
+	// has no PAC, including all callers when Settings does not decode the PAC.
+	DenyProtocolTransitionMethods map[string]bool
+	// Config is the krb5.conf used by clients for forwarded TGTs.
+	// Defaults to that named by the KRB5_CONFIG environment variable, or /etc/krb5.conf.
+	Config *config.Config
+
+	rcOnce  sync.Once
+	rc      ReplayCache
+	cfgOnce sync.Once
+	cfg     *config.Config
+	cfgErr  error
 }
 
 func NewKRBServerInterceptor(kt *keytab.Keytab, logger *log.Logger) *KRBServerInterceptor {
@@ -42,7 +102,7 @@ func (i *KRBServerInterceptor) Unary() grpc.UnaryServerInterceptor {
 			}
 		}
 
-		identity, err := i.authn(ctx)
+		identity, apx, err := i.authn(ctx, info.FullMethod)
 		if err != nil {
 			i.Settings.Logger().Printf("kerberos authentication failed for request to %s: %v", info.FullMethod, err)
 			return nil, err
@@ -50,10 +110,24 @@ func (i *KRBServerInterceptor) Unary() grpc.UnaryServerInterceptor {
 
 		if !i.authz(identity, info.FullMethod) {
 			i.Settings.Logger().Printf("user %s not authorized for request to %s", identity.UserName(), info.FullMethod)
-			return nil, status.Errorf(codes.Unauthenticated, "user unauthorised for call")
+			return nil, authError(codes.PermissionDenied, ReasonPermissionDenied, "user not authorised for call")
+		}
+		if err := i.checkProtocolTransition(identity, info.FullMethod); err != nil {
+			return nil, err
 		}
 
 		i.Settings.Logger().Printf("user %s@%s authorised to access %s", identity.UserName(), identity.Domain(), info.FullMethod)
+		if md, ok, err := apx.reply(); ok {
+			if err != nil {
+				i.Settings.Logger().Printf("could not create authentication reply for request to %s: %v", info.FullMethod, err)
+				return nil, authError(codes.Internal, ReasonInternal, "could not create authentication reply")
+			}
+			err = grpc.SetHeader(ctx, md)
+			if err != nil {
+				return nil, err
+			}
+		}
+		ctx = context.WithValue(ctx, principalCtxKey{}, newPrincipal(identity, apx))
 		return handler(ctx, req)
 	}
 }
@@ -67,7 +141,7 @@ func (i *KRBServerInterceptor) Stream() grpc.StreamServerInterceptor {
 			}
 		}
 
-		identity, err := i.authn(ss.Context())
+		identity, apx, err := i.authn(ss.Context(), info.FullMethod)
 		if err != nil {
 			i.Settings.Logger().Printf("kerberos authentication failed for request to %s: %v", info.FullMethod, err)
 			return err
@@ -75,50 +149,288 @@ func (i *KRBServerInterceptor) Stream() grpc.StreamServerInterceptor {
 
 		if !i.authz(identity, info.FullMethod) {
 			i.Settings.Logger().Printf("user %s not authorized for request to %s", identity.UserName(), info.FullMethod)
-			return status.Errorf(codes.Unauthenticated, "user not authorised for call")
+			return authError(codes.PermissionDenied, ReasonPermissionDenied, "user not authorised for call")
+		}
+		if err := i.checkProtocolTransition(identity, info.FullMethod); err != nil {
+			return err
 		}
 
 		i.Settings.Logger().Printf("user %s@%s authorised to access %s", identity.UserName(), identity.Domain(), info.FullMethod)
-		return handler(srv, ss)
+		if md, ok, err := apx.reply(); ok {
+			if err != nil {
+				i.Settings.Logger().Printf("could not create authentication reply for request to %s: %v", info.FullMethod, err)
+				return authError(codes.Internal, ReasonInternal, "could not create authentication reply")
+			}
+			err = ss.SetHeader(md)
+			if err != nil {
+				return err
+			}
+		}
+		ctx := context.WithValue(ss.Context(), principalCtxKey{}, newPrincipal(identity, apx))
+		return handler(srv, &wrappedServerStream{ServerStream: ss, ctx: ctx})
 	}
 }
 
-func (i *KRBServerInterceptor) authn(ctx context.Context) (goidentity.Identity, error) {
+func (i *KRBServerInterceptor) authn(ctx context.Context, method string) (*credentials.Credentials, *apExchange, error) {
 	md, ok := metadata.FromIncomingContext(ctx)
 	if !ok {
-		return nil, status.Errorf(codes.Unauthenticated, "metadata is not provided")
+		return nil, nil, authError(codes.Unauthenticated, ReasonMissingToken, "metadata is not provided")
 	}
 
 	values := md[MDField]
 	if len(values) == 0 {
-		return nil, status.Errorf(codes.Unauthenticated, "authorization token is not provided")
+		return nil, nil, authError(codes.Unauthenticated, ReasonMissingToken, "authorization token is not provided")
 	}
 
-	//base 64 decode string
-	b, err := base64.StdEncoding.DecodeString(values[0])
+	apReq, format, err := decodeAPReq(values[0])
 	if err != nil {
-		// log for server side here
-		return nil, status.Errorf(codes.Unauthenticated, "malformed authorization token")
+		return nil, nil, authError(codes.Unauthenticated, ReasonInvalidToken, err.Error())
 	}
 
-	apReq := new(messages.APReq)
-	err = apReq.Unmarshal(b)
+	err = i.checkSPN(md, apReq.Ticket)
 	if err != nil {
-		return nil, status.Errorf(codes.Unauthenticated, "malformed AP_REQ authorization token")
+		return nil, nil, err
 	}
-
-	ok, creds, err := service.VerifyAPREQ(apReq, i.Settings)
+	ok, creds, err := i.verifyAPReq(ctx, apReq)
 	if err != nil {
-		return nil, status.Errorf(codes.Unauthenticated, "error verifying AP_REQ authorization token: %v", err)
+		return nil, nil, verifyError(err)
 	}
 	if !ok {
-		return nil, status.Errorf(codes.Unauthenticated, "authentication failure")
+		return nil, nil, authError(codes.Unauthenticated, ReasonInvalidToken, "authentication failure")
+	}
+	if !i.realmAllowed(creds.Domain()) {
+		return nil, nil, authError(codes.Unauthenticated, ReasonUntrustedRealm, "callers from realm %s are not accepted", creds.Domain())
+	}
+	err = i.checkMethodBinding(apReq.Authenticator, method)
+	if err != nil {
+		return nil, nil, err
+	}
+	apx := &apExchange{apReq: apReq, format: format}
+	if i.ForwardedTGTMethods[method] {
+		apx.forwarded, err = i.forwardedClient(apReq)
+		if err != nil {
+			return nil, nil, authError(codes.Unauthenticated, ReasonInvalidToken, "could not use the forwarded TGT: %v", err)
+		}
 	}
 	var fqpn strings.Builder
 	fmt.Fprintf(&fqpn, "%s@%s", creds.UserName(), creds.Domain())
 	creds.AddAuthzAttribute(fqpn.String())
 
-	return creds, nil
+	return creds, apx, nil
+}
+
+// apExchange holds the server side state of a verified AP exchange.
+type apExchange struct {
+	apReq  *messages.APReq
+	format TokenFormat
+	// forwarded is the client for the TGT forwarded by the caller
+	forwarded *client.Client
+}
+
+// reply returns the response header to send to the client, if any.
+// This carries an AP_REP if the client asked for mutual authentication and completes the negotiation for SPNEGO clients.
+func (x *apExchange) reply() (metadata.MD, bool, error) {
+	mutual := types.IsFlagSet(&x.apReq.APOptions, flags.APOptionMutualRequired)
+	if !mutual && x.format != TokenFormatSPNEGO {
+		return nil, false, nil
+	}
+	var b []byte
+	if mutual {
+		var err error
+		b, err = newAPRep(x.apReq)
+		if err != nil {
+			return nil, true, err
+		}
+	}
+	v, err := encodeAPRep(b, x.format)
+	if err != nil {
+		return nil, true, err
+	}
+	return metadata.Pairs(MDReplyField, v), true, nil
+}
+
+// newAPRep creates a marshaled KRB_AP_REP in response to the verified AP_REQ provided.
+func newAPRep(apReq *messages.APReq) ([]byte, error) {
+	encPart := messages.EncAPRepPart{
+		CTime:          apReq.Authenticator.CTime,
+		Cusec:          apReq.Authenticator.Cusec,
+		Subkey:         apReq.Authenticator.SubKey,
+		SequenceNumber: apReq.Authenticator.SeqNumber,
+	}
+	b, err := asn1.Marshal(encPart)
+	if err != nil {
+		return nil, err
+	}
+	b = asn1tools.AddASNAppTag(b, asnAppTag.EncAPRepPart)
+	ed, err := crypto.GetEncryptedData(b, apReq.Ticket.DecryptedEncPart.Key, keyusage.AP_REP_ENCPART, 0)
+	if err != nil {
+		return nil, err
+	}
+	apRep := messages.APRep{
+		PVNO:    iana.PVNO,
+		MsgType: msgtype.KRB_AP_REP,
+		EncPart: ed,
+	}
+	b, err = asn1.Marshal(apRep)
+	if err != nil {
+		return nil, err
+	}
+	return asn1tools.AddASNAppTag(b, asnAppTag.APREP), nil
+}
+
+// verifyAPReq verifies the AP_REQ as service.VerifyAPREQ does but checks for replays using the interceptor's ReplayCache.
+func (i *KRBServerInterceptor) verifyAPReq(ctx context.Context, apReq *messages.APReq) (bool, *credentials.Credentials, error) {
+	s := i.Settings
+	kt := i.keytab()
+	if kt == nil {
+		return false, nil, errKeytabUnavailable
+	}
+	ok, err := apReq.Verify(kt, s.MaxClockSkew(), s.ClientAddress(), s.KeytabPrincipal())
+	if err != nil || !ok {
+		return false, nil, err
+	}
+
+	// the client is identified by the ticket the KDC issued rather than the authenticator it wrote itself
+	tktPart := apReq.Ticket.DecryptedEncPart
+	if !apReq.Authenticator.CName.Equal(tktPart.CName) || apReq.Authenticator.CRealm != tktPart.CRealm {
+		return false, nil,
+			messages.NewKRBError(apReq.Ticket.SName, apReq.Ticket.Realm, errorcode.KRB_AP_ERR_BADMATCH, "authenticator client does not match the ticket")
+	}
+
+	if s.RequireHostAddr() && len(apReq.Ticket.DecryptedEncPart.CAddr) < 1 {
+		return false, nil,
+			messages.NewKRBError(apReq.Ticket.SName, apReq.Ticket.Realm, errorcode.KRB_AP_ERR_BADADDR, "ticket does not contain HostAddress values required")
+	}
+
+	key := ReplayKey{
+		CName: tktPart.CName.PrincipalNameString() + "@" + tktPart.CRealm,
+		CTime: apReq.Authenticator.CTime,
+		Cusec: apReq.Authenticator.Cusec,
+		SName: apReq.Ticket.SName.PrincipalNameString() + "@" + apReq.Ticket.Realm,
+	}
+	replay, err := i.replayCache().IsReplay(ctx, key, replayTTL(key.CTime, s.MaxClockSkew()))
+	if err != nil {
+		return false, nil, replayCacheError{err: err}
+	}
+	if replay {
+		return false, nil,
+			messages.NewKRBError(apReq.Ticket.SName, apReq.Ticket.Realm, errorcode.KRB_AP_ERR_REPEAT, "replay detected")
+	}
+
+	creds := credentials.NewFromPrincipalName(tktPart.CName, tktPart.CRealm)
+	creds.SetAuthTime(time.Now().UTC())
+	creds.SetAuthenticated(true)
+	creds.SetValidUntil(apReq.Ticket.DecryptedEncPart.EndTime)
+
+	if s.DecodePAC() {
+		isPAC, pac, err := apReq.Ticket.GetPACType(kt, s.KeytabPrincipal(), s.Logger())
+		if isPAC && err != nil {
+			return false, nil, err
+		}
+		if isPAC {
+			creds.SetADCredentials(credentials.ADCredentials{
+				GroupMembershipSIDs: pac.KerbValidationInfo.GetGroupMembershipSIDs(),
+				LogOnTime:           pac.KerbValidationInfo.LogOnTime.Time(),
+				LogOffTime:          pac.KerbValidationInfo.LogOffTime.Time(),
+				PasswordLastSet:     pac.KerbValidationInfo.PasswordLastSet.Time(),
+				EffectiveName:       pac.KerbValidationInfo.EffectiveName.Value,
+				FullName:            pac.KerbValidationInfo.FullName.Value,
+				UserID:              int(pac.KerbValidationInfo.UserID),
+				PrimaryGroupID:      int(pac.KerbValidationInfo.PrimaryGroupID),
+				LogonServer:         pac.KerbValidationInfo.LogonServer.Value,
+				LogonDomainName:     pac.KerbValidationInfo.LogonDomainName.Value,
+				LogonDomainID:       pac.KerbValidationInfo.LogonDomainID.String(),
+			})
+		}
+	}
+	return true, creds, nil
+}
+
+// checkSPN checks the service principal the ticket was issued for against AcceptedSPNs and the :authority of the call.
+func (i *KRBServerInterceptor) checkSPN(md metadata.MD, tkt messages.Ticket) error {
+	spn := tkt.SName.PrincipalNameString()
+	if len(i.AcceptedSPNs) > 0 {
+		var accepted bool
+		for _, a := range i.AcceptedSPNs {
+			if a == spn || a == spn+"@"+tkt.Realm {
+				accepted = true
+				break
+			}
+		}
+		if !accepted {
+			return authError(codes.Unauthenticated, ReasonWrongSPN, "ticket for %s@%s is not accepted by this server", spn, tkt.Realm)
+		}
+	}
+	if i.CheckAuthority {
+		var authority string
+		if v := md[":authority"]; len(v) > 0 {
+			authority = strings.TrimSuffix(strings.ToLower(endpointHost(v[0])), ".")
+		}
+		if len(tkt.SName.NameString) < 2 || !strings.EqualFold(strings.TrimSuffix(tkt.SName.NameString[1], "."), authority) {
+			return authError(codes.Unauthenticated, ReasonWrongSPN, "ticket for %s does not match the authority %q of the call", spn, authority)
+		}
+	}
+	return nil
+}
+
+// keytab returns the keytab from the KeytabSource if set or else from the Settings.
+func (i *KRBServerInterceptor) keytab() *keytab.Keytab {
+	if i.KeytabSource != nil {
+		return i.KeytabSource.Keytab()
+	}
+	return i.Settings.Keytab
+}
+
+func (i *KRBServerInterceptor) replayCache() ReplayCache {
+	if i.ReplayCache != nil {
+		return i.ReplayCache
+	}
+	i.rcOnce.Do(func() {
+		i.rc = NewMemoryReplayCache(16)
+	})
+	return i.rc
+}
+
+// checkMethodBinding verifies the authenticator was created for the method being called.
+// Without this a token captured on one method could be replayed against another within the clock skew window.
+func (i *KRBServerInterceptor) checkMethodBinding(auth types.Authenticator, method string) error {
+	var bound, match bool
+	switch auth.Cksum.CksumType {
+	case methodBindingCksumType:
+		bound = true
+		match = string(auth.Cksum.Checksum) == method
+	case chksumtype.GSSAPI:
+		bnd, _, err := parseGSSChecksum(auth.Cksum.Checksum)
+		if err != nil {
+			return authError(codes.Unauthenticated, ReasonInvalidToken, "malformed GSS-API checksum in authenticator: %v", err)
+		}
+		// all zeros indicates the client did not provide any channel bindings
+		bound = !bytes.Equal(bnd, make([]byte, len(bnd)))
+		match = bytes.Equal(bnd, methodChannelBindings(method))
+	}
+	if !bound {
+		if i.MethodBinding == AllowUnboundTokens {
+			return nil
+		}
+		return authError(codes.Unauthenticated, ReasonMethodBinding, "authorization token is not bound to a method")
+	}
+	if !match {
+		return authError(codes.Unauthenticated, ReasonMethodBinding, "authorization token is bound to a different method")
+	}
+	return nil
+}
+
+// realmAllowed reports whether callers from the realm are accepted.
+func (i *KRBServerInterceptor) realmAllowed(realm string) bool {
+	if len(i.AllowedRealms) == 0 {
+		return true
+	}
+	for _, r := range i.AllowedRealms {
+		if r == realm {
+			return true
+		}
+	}
+	return false
 }
 
 func (i *KRBServerInterceptor) authz(identity goidentity.Identity, method string) bool {
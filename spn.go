@@ -0,0 +1,371 @@
+package grpc_krb
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DNSCanonicalization defines how the host taken from the target is canonicalized using DNS before forming an SPN.
+type DNSCanonicalization int
+
+const (
+	// NoCanonicalization uses the host as given in the target.
+	NoCanonicalization DNSCanonicalization = iota
+	// CanonicalizeCNAME follows CNAME records from the host to its canonical name.
+	CanonicalizeCNAME
+	// CanonicalizeRDNS follows CNAME records and then uses the name from a reverse lookup of the host's address,
+	// as MIT Kerberos does with the rdns setting.
+	CanonicalizeRDNS
+)
+
+// canonicalNameTTL is how long the canonical name of a host is remembered for.
+const canonicalNameTTL = 5 * time.Minute
+
+// canonicalNameFailureTTL is how long a host is left as it is after a lookup fails, before the lookups are tried again.
+const canonicalNameFailureTTL = 10 * time.Second
+
+// Resolver performs the DNS lookups used to canonicalize host names. *net.Resolver implements this interface.
+type Resolver interface {
+	LookupCNAME(ctx context.Context, host string) (string, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// canonicalNames remembers the canonical names of hosts.
+type canonicalNames struct {
+	mux     sync.Mutex
+	entries map[string]canonicalName
+}
+
+type canonicalName struct {
+	name    string
+	expires time.Time
+}
+
+// spnChoices remembers which of the candidate SPNs worked for each target.
+type spnChoices struct {
+	mux     sync.Mutex
+	entries map[spnChoiceKey]string
+}
+
+type spnChoiceKey struct {
+	// target is the dial target or the address connected to
+	target string
+	// spns are the candidate SPNs joined with spaces
+	spns string
+}
+
+// spnChoice is the SPN chosen for a call from its candidates.
+type spnChoice struct {
+	key  spnChoiceKey
+	spns []string
+	n    int
+}
+
+func (c spnChoice) spn() string {
+	return c.spns[c.n]
+}
+
+// SPNRule maps the calls matching a pattern to an SPN.
+type SPNRule struct {
+	// Match is either a full method name such as /pkg.Service/Method or a prefix ending in *.
+	// For example /pkg.Service/* matches all methods of a service, /pkg.* all services in a package and * every call.
+	Match string
+	// SPN is the SPN to use, which may contain the placeholders:
+	// {host} - the host from the target, canonicalized as set by DNSCanonicalization.
+	// {service} - the name of the GRPC service called without its package.
+	// {package} - the package of the GRPC service called.
+	// {realm} - the realm of the client.
+	SPN string
+}
+
+func (r SPNRule) matches(method string) bool {
+	if strings.HasSuffix(r.Match, "*") {
+		return strings.HasPrefix(method, strings.TrimSuffix(r.Match, "*"))
+	}
+	return method == r.Match
+}
+
+// resolveSPN returns the SPN for a call to the method on the target, or on the address connected to if addr is given.
+// The first of these that applies is used: the MethodSPNs entry for the method, the first of the SPNRules that matches,
+// the DefaultSPN and finally GRPC/{host}.
+func (i *KRBClientInterceptor) resolveSPN(ctx context.Context, target, method string, addr *AddressAuthInfo) (string, error) {
+	if spn, ok := i.MethodSPNs[method]; ok {
+		return i.expandSPN(ctx, spn, target, method, addr)
+	}
+	for _, r := range i.SPNRules {
+		if r.matches(method) {
+			return i.expandSPN(ctx, r.SPN, target, method, addr)
+		}
+	}
+	if i.DefaultSPN != "" {
+		return i.expandSPN(ctx, i.DefaultSPN, target, method, addr)
+	}
+	return i.expandSPN(ctx, "GRPC/{host}", target, method, addr)
+}
+
+// candidateSPNs returns the SPN resolved for the call followed by the FallbackSPNs, without duplicates.
+func (i *KRBClientInterceptor) candidateSPNs(ctx context.Context, target, method string, addr *AddressAuthInfo) ([]string, error) {
+	spn, err := i.resolveSPN(ctx, target, method, addr)
+	if err != nil {
+		return nil, err
+	}
+	spns := []string{spn}
+	for _, tmpl := range i.FallbackSPNs {
+		spn, err := i.expandSPN(ctx, tmpl, target, method, addr)
+		if err != nil {
+			return nil, err
+		}
+		if !containsString(spns, spn) {
+			spns = append(spns, spn)
+		}
+	}
+	return spns, nil
+}
+
+// chooseSPN returns the SPN to try first for a call, which is the one that last worked for the target.
+func (i *KRBClientInterceptor) chooseSPN(ctx context.Context, target, method string, addr *AddressAuthInfo) (spnChoice, error) {
+	spns, err := i.candidateSPNs(ctx, target, method, addr)
+	if err != nil {
+		return spnChoice{}, err
+	}
+	if addr != nil {
+		target = addr.Addr.String()
+	}
+	c := spnChoice{
+		key:  spnChoiceKey{target: target, spns: strings.Join(spns, " ")},
+		spns: spns,
+	}
+	if len(spns) == 1 {
+		return c, nil
+	}
+	i.spns.mux.Lock()
+	defer i.spns.mux.Unlock()
+	for n, spn := range spns {
+		if spn == i.spns.entries[c.key] {
+			c.n = n
+		}
+	}
+	return c, nil
+}
+
+// nextSPN moves on from an SPN that was rejected to the next candidate, remembering this for later calls to the target.
+// If all the candidates have been tried false is returned and the next call starts again from the first.
+func (i *KRBClientInterceptor) nextSPN(c *spnChoice) bool {
+	if len(c.spns) == 1 {
+		return false
+	}
+	i.spns.mux.Lock()
+	defer i.spns.mux.Unlock()
+	if i.spns.entries == nil {
+		i.spns.entries = make(map[spnChoiceKey]string)
+	}
+	if c.n+1 >= len(c.spns) {
+		delete(i.spns.entries, c.key)
+		return false
+	}
+	c.n++
+	i.spns.entries[c.key] = c.spn()
+	return true
+}
+
+func containsString(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// expandSPN replaces the placeholders in an SPN template.
+func (i *KRBClientInterceptor) expandSPN(ctx context.Context, tmpl, target, method string, addr *AddressAuthInfo) (string, error) {
+	if !strings.Contains(tmpl, "{") {
+		return tmpl, nil
+	}
+	var host, realm string
+	if strings.Contains(tmpl, "{host}") {
+		var err error
+		if addr != nil {
+			host, err = i.addressHost(ctx, addr)
+		} else {
+			host, err = i.canonicalTargetHost(ctx, target)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	if _, cl, err := i.callClient(ctx); err == nil && cl != nil {
+		realm = cl.Credentials.Domain()
+	}
+	pkg, svc := splitMethod(method)
+	spn := strings.NewReplacer("{host}", host, "{service}", svc, "{package}", pkg, "{realm}", realm).Replace(tmpl)
+	name := spn
+	if n := strings.LastIndex(name, "@"); n >= 0 {
+		if n == len(name)-1 {
+			return "", authError(codes.Unauthenticated, ReasonNoSPN, "SPN template %q for method %s gives an empty realm", tmpl, method)
+		}
+		name = name[:n]
+	}
+	if strings.ContainsAny(spn, "{}") {
+		return "", authError(codes.Unauthenticated, ReasonNoSPN, "SPN template %q has an unknown placeholder", tmpl)
+	}
+	for _, c := range strings.Split(name, "/") {
+		if c == "" {
+			return "", authError(codes.Unauthenticated, ReasonNoSPN, "SPN template %q for method %s gives an SPN with an empty component: %s", tmpl, method, spn)
+		}
+	}
+	return spn, nil
+}
+
+// canonicalTargetHost returns the host from the target canonicalized as set by DNSCanonicalization.
+func (i *KRBClientInterceptor) canonicalTargetHost(ctx context.Context, target string) (string, error) {
+	host, err := targetHost(target)
+	if err != nil {
+		return "", err
+	}
+	return i.canonicalHost(ctx, host)
+}
+
+// splitMethod returns the package and service from a full method name in the form /pkg.Service/Method.
+func splitMethod(method string) (string, string) {
+	svc := strings.TrimPrefix(method, "/")
+	if n := strings.Index(svc, "/"); n >= 0 {
+		svc = svc[:n]
+	}
+	if n := strings.LastIndex(svc, "."); n >= 0 {
+		return svc[:n], svc[n+1:]
+	}
+	return "", svc
+}
+
+// targetHost returns the lower case host name from a GRPC dial target.
+// The dns, passthrough, ipv4, ipv6, unix and unix-abstract naming schemes are understood as well as targets with no scheme.
+// Unix domain sockets are served from the local host so its name is returned for them.
+func targetHost(target string) (string, error) {
+	scheme, endpoint := parseTarget(target)
+	var host string
+	switch scheme {
+	case "unix", "unix-abstract":
+		h, err := os.Hostname()
+		if err != nil {
+			return "", authError(codes.Unauthenticated, ReasonNoSPN, "could not determine local host name for target %s: %v", target, err)
+		}
+		host = h
+	case "ipv4", "ipv6":
+		// a comma separated list of addresses
+		if n := strings.Index(endpoint, ","); n >= 0 {
+			endpoint = endpoint[:n]
+		}
+		host = endpointHost(endpoint)
+	default:
+		host = endpointHost(endpoint)
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" {
+		return "", authError(codes.Unauthenticated, ReasonNoSPN, "could not derive a host for the SPN from target %q", target)
+	}
+	return host, nil
+}
+
+// parseTarget splits the target into its naming scheme and endpoint, dropping any authority.
+// A target without a scheme is treated as passthrough.
+func parseTarget(target string) (string, string) {
+	var scheme, rest string
+	if n := strings.Index(target, "://"); n > 0 {
+		scheme, rest = target[:n], target[n+3:]
+		// the authority is up to the next slash
+		if n = strings.Index(rest, "/"); n >= 0 {
+			return strings.ToLower(scheme), rest[n+1:]
+		}
+		return strings.ToLower(scheme), ""
+	}
+	if n := strings.Index(target, ":"); n > 0 {
+		switch s := strings.ToLower(target[:n]); s {
+		case "dns", "passthrough", "ipv4", "ipv6", "unix", "unix-abstract":
+			return s, target[n+1:]
+		}
+	}
+	return "passthrough", target
+}
+
+// endpointHost returns the host from an endpoint in the forms host, host:port, an IP address, [ipv6] or [ipv6]:port.
+func endpointHost(endpoint string) string {
+	if strings.HasPrefix(endpoint, "[") {
+		if n := strings.Index(endpoint, "]"); n > 0 {
+			return endpoint[1:n]
+		}
+		return ""
+	}
+	if net.ParseIP(endpoint) != nil {
+		return endpoint
+	}
+	if host, _, err := net.SplitHostPort(endpoint); err == nil {
+		return host
+	}
+	return endpoint
+}
+
+// canonicalHost canonicalizes the host name using DNS as set by the DNSCanonicalization field.
+// If a lookup fails the name is left as it is, and only remembered briefly so a transient failure is soon retried.
+func (i *KRBClientInterceptor) canonicalHost(ctx context.Context, host string) (string, error) {
+	if i.DNSCanonicalization == NoCanonicalization {
+		return host, nil
+	}
+	now := time.Now()
+	i.canon.mux.Lock()
+	if c, ok := i.canon.entries[host]; ok && now.Before(c.expires) {
+		i.canon.mux.Unlock()
+		return c.name, nil
+	}
+	i.canon.mux.Unlock()
+
+	var r Resolver = net.DefaultResolver
+	if i.Resolver != nil {
+		r = i.Resolver
+	}
+	name := host
+	ttl := canonicalNameTTL
+	if net.ParseIP(host) == nil {
+		cname, err := r.LookupCNAME(ctx, host)
+		if err == nil && cname != "" {
+			name = cname
+		} else {
+			ttl = canonicalNameFailureTTL
+		}
+	}
+	if i.DNSCanonicalization == CanonicalizeRDNS {
+		addr := name
+		if net.ParseIP(addr) == nil {
+			addrs, err := r.LookupHost(ctx, name)
+			if err == nil && len(addrs) > 0 {
+				addr = addrs[0]
+			}
+		}
+		names, err := r.LookupAddr(ctx, addr)
+		if err == nil && len(names) > 0 {
+			name = names[0]
+		} else {
+			ttl = canonicalNameFailureTTL
+		}
+	}
+	if ctx.Err() != nil {
+		return "", status.FromContextError(ctx.Err()).Err()
+	}
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+
+	i.canon.mux.Lock()
+	defer i.canon.mux.Unlock()
+	if i.canon.entries == nil {
+		i.canon.entries = make(map[string]canonicalName)
+	}
+	i.canon.entries[host] = canonicalName{name: name, expires: now.Add(ttl)}
+	return name, nil
+}
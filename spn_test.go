@@ -0,0 +1,283 @@
+package grpc_krb
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/grpckrb/test"
+	"google.golang.org/grpc"
+)
+
+func TestTargetHost(t *testing.T) {
+	hostname, _ := os.Hostname()
+	var tests = []struct {
+		target string
+		host   string
+	}{
+		{"svc.example.com:443", "svc.example.com"},
+		{"svc.example.com", "svc.example.com"},
+		{"SVC.Example.COM.:443", "svc.example.com"},
+		{"dns:///svc.example.com:443", "svc.example.com"},
+		{"dns://8.8.8.8/svc.example.com", "svc.example.com"},
+		{"dns:svc.example.com:443", "svc.example.com"},
+		{"passthrough:///svc.example.com:443", "svc.example.com"},
+		{"ipv4:10.0.0.1:443,10.0.0.2:443", "10.0.0.1"},
+		{"ipv6:[2001:db8::1]:443", "2001:db8::1"},
+		{"[::1]", "::1"},
+		{"[::1]:443", "::1"},
+		{"::1", "::1"},
+		{"127.0.0.1:443", "127.0.0.1"},
+		{"unix:///run/app.sock", strings.ToLower(hostname)},
+		{"unix:app.sock", strings.ToLower(hostname)},
+	}
+	for _, tt := range tests {
+		host, err := targetHost(tt.target)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.target, err)
+			continue
+		}
+		if host != tt.host {
+			t.Errorf("%s: expected host %s, got %s", tt.target, tt.host, host)
+		}
+	}
+
+	for _, target := range []string{"", "dns:///", "[]:443"} {
+		_, err := targetHost(target)
+		if ErrorReason(err) != ReasonNoSPN {
+			t.Errorf("%q: expected an error deriving the host, got: %v", target, err)
+		}
+	}
+}
+
+type testResolver struct {
+	cnames map[string]string
+	hosts  map[string][]string
+	addrs  map[string][]string
+}
+
+var errNotFound = errors.New("not found")
+
+func (r *testResolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	if c, ok := r.cnames[host]; ok {
+		return c, nil
+	}
+	return "", errNotFound
+}
+
+func (r *testResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if a, ok := r.hosts[host]; ok {
+		return a, nil
+	}
+	return nil, errNotFound
+}
+
+func (r *testResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if n, ok := r.addrs[addr]; ok {
+		return n, nil
+	}
+	return nil, errNotFound
+}
+
+func TestResolveSPN_DNSCanonicalization(t *testing.T) {
+	r := &testResolver{
+		cnames: map[string]string{"svc.example.com": "Node1.Example.com."},
+		hosts:  map[string][]string{"Node1.Example.com.": {"10.0.0.1"}},
+		addrs:  map[string][]string{"10.0.0.1": {"node1-ptr.example.com."}},
+	}
+	var tests = []struct {
+		mode   DNSCanonicalization
+		target string
+		spn    string
+	}{
+		{NoCanonicalization, "dns:///svc.example.com:443", "GRPC/svc.example.com"},
+		{CanonicalizeCNAME, "dns:///svc.example.com:443", "GRPC/node1.example.com"},
+		{CanonicalizeRDNS, "dns:///svc.example.com:443", "GRPC/node1-ptr.example.com"},
+		{CanonicalizeRDNS, "10.0.0.1:443", "GRPC/node1-ptr.example.com"},
+		// lookup failures leave the name as it is
+		{CanonicalizeCNAME, "other.example.com:443", "GRPC/other.example.com"},
+		{CanonicalizeRDNS, "other.example.com:443", "GRPC/other.example.com"},
+	}
+	for _, tt := range tests {
+		ci := &KRBClientInterceptor{
+			DNSCanonicalization: tt.mode,
+			Resolver:            r,
+		}
+		spn, err := ci.resolveSPN(context.Background(), tt.target, "/Service/Reflector", nil)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.target, err)
+			continue
+		}
+		if spn != tt.spn {
+			t.Errorf("%s (mode %d): expected SPN %s, got %s", tt.target, tt.mode, tt.spn, spn)
+		}
+	}
+}
+
+func TestCanonicalHost_FailureTTL(t *testing.T) {
+	r := &testResolver{
+		cnames: map[string]string{"svc.example.com": "node1.example.com"},
+		hosts:  map[string][]string{"node1.example.com": {"10.0.0.1"}},
+		addrs:  map[string][]string{"10.0.0.1": {"node1.example.com"}},
+	}
+	ci := &KRBClientInterceptor{DNSCanonicalization: CanonicalizeRDNS, Resolver: r}
+	for _, host := range []string{"svc.example.com", "other.example.com"} {
+		if _, err := ci.canonicalHost(context.Background(), host); err != nil {
+			t.Fatalf("%s: unexpected error: %v", host, err)
+		}
+	}
+	if d := time.Until(ci.canon.entries["svc.example.com"].expires); d <= canonicalNameFailureTTL {
+		t.Errorf("expected the canonical name to be remembered for %v, expires in %v", canonicalNameTTL, d)
+	}
+	if d := time.Until(ci.canon.entries["other.example.com"].expires); d > canonicalNameFailureTTL {
+		t.Errorf("expected a failed lookup to be remembered for at most %v, expires in %v", canonicalNameFailureTTL, d)
+	}
+}
+
+func TestResolveSPN_Rules(t *testing.T) {
+	cl, err := testKDC.NewClient("testuser1")
+	if err != nil {
+		t.Fatalf("could not create client: %v", err)
+	}
+	ci := &KRBClientInterceptor{
+		KRBClient:  cl,
+		MethodSPNs: map[string]string{"/pkg.Service/Exact": "HTTP/exact.example.com"},
+		SPNRules: []SPNRule{
+			{Match: "/pkg.Service/Exact", SPN: "HTTP/not-used.example.com"},
+			{Match: "/pkg.Service/*", SPN: "HOST/{host}@{realm}"},
+			{Match: "/pkg.*", SPN: "{service}/{host}"},
+			{Match: "/other.Service/Method", SPN: "{package}/{host}"},
+		},
+		DefaultSPN: "HTTP/default.example.com",
+	}
+	var tests = []struct {
+		method string
+		spn    string
+	}{
+		{"/pkg.Service/Exact", "HTTP/exact.example.com"},
+		{"/pkg.Service/Method", "HOST/svc.example.com@TEST.GOKRB5"},
+		{"/pkg.Other/Method", "Other/svc.example.com"},
+		{"/pkg.sub.Other/Method", "Other/svc.example.com"},
+		{"/other.Service/Method", "other/svc.example.com"},
+		{"/other.Service/Another", "HTTP/default.example.com"},
+	}
+	for _, tt := range tests {
+		spn, err := ci.resolveSPN(context.Background(), "dns:///svc.example.com:443", tt.method, nil)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.method, err)
+			continue
+		}
+		if spn != tt.spn {
+			t.Errorf("%s: expected SPN %s, got %s", tt.method, tt.spn, spn)
+		}
+	}
+
+	// templates that cannot be filled fail the call
+	for _, tmpl := range []string{"{package}/{host}", "GRPC/{hostname}", "HOST/{host}@"} {
+		ci := &KRBClientInterceptor{SPNRules: []SPNRule{{Match: "*", SPN: tmpl}}}
+		_, err := ci.resolveSPN(context.Background(), "svc.example.com:443", "/Service/Reflector", nil)
+		if ErrorReason(err) != ReasonNoSPN {
+			t.Errorf("%s: expected an error expanding the template, got: %v", tmpl, err)
+		}
+	}
+}
+
+func TestFallbackSPNs(t *testing.T) {
+	// the server only has the key for the new SPN while the old one is still known to the KDC
+	if _, err := testKDC.AddPrincipal("HTTP/old.test.gokrb5"); err != nil {
+		t.Fatalf("could not add principal: %v", err)
+	}
+	srv, addr := newSPNTestServer(t, "GRPC/new.test.gokrb5")
+	defer srv.Stop()
+
+	dial := func(ci *KRBClientInterceptor) *grpc.ClientConn {
+		conn, err := connectWithInterceptor(addr.String(), ci)
+		if err != nil {
+			t.Fatalf("could not create client connection: %v", err)
+		}
+		return conn
+	}
+
+	var tests = []struct {
+		name      string
+		spn       string
+		fallbacks []string
+	}{
+		{"unknown to KDC", "HTTP/unknown.test.gokrb5", []string{"GRPC/new.test.gokrb5"}},
+		{"rejected by server", "HTTP/old.test.gokrb5", []string{"HTTP/unknown.test.gokrb5", "GRPC/new.test.gokrb5"}},
+	}
+	for _, tt := range tests {
+		ci := newClientInterceptor(tt.spn, "testuser1")
+		ci.FallbackSPNs = tt.fallbacks
+		ci.MutualAuth = true
+		conn := dial(ci)
+		client := test.NewServiceClient(conn)
+		_, err := client.Reflector(context.Background(), &test.Request{RequestInt: 1})
+		if err != nil {
+			t.Errorf("%s: call should have succeeded with a fallback SPN: %v", tt.name, err)
+		}
+		c, _ := ci.chooseSPN(context.Background(), conn.Target(), "/Service/Reflector", nil)
+		if c.spn() != "GRPC/new.test.gokrb5" {
+			t.Errorf("%s: the SPN that worked was not remembered, got %s", tt.name, c.spn())
+		}
+		stream, err := client.Mirror(context.Background())
+		if err != nil {
+			t.Fatalf("%s: could not create client stream: %v", tt.name, err)
+		}
+		stream.CloseSend()
+		if _, err := stream.Recv(); err != io.EOF {
+			t.Errorf("%s: error receiving from stream: %v", tt.name, err)
+		}
+		conn.Close()
+		ci.Close()
+	}
+
+	// when every candidate is rejected the call fails and the next starts again from the first
+	ci := newClientInterceptor("HTTP/old.test.gokrb5", "testuser1")
+	ci.FallbackSPNs = []string{"HTTP/unknown.test.gokrb5"}
+	defer ci.Close()
+	conn := dial(ci)
+	defer conn.Close()
+	_, err := test.NewServiceClient(conn).Reflector(context.Background(), &test.Request{RequestInt: 1})
+	if ErrorReason(err) != ReasonWrongSPN {
+		t.Errorf("expected the call to be rejected for the SPN, got: %v", err)
+	}
+	c, _ := ci.chooseSPN(context.Background(), conn.Target(), "/Service/Reflector", nil)
+	if c.spn() != "HTTP/old.test.gokrb5" {
+		t.Errorf("expected the first candidate to be tried next, got %s", c.spn())
+	}
+
+	// a rejected stream moves later calls on to the next candidate, including when the server's AP_REP is expected
+	for _, mutual := range []bool{false, true} {
+		ci := newClientInterceptor("HTTP/old.test.gokrb5", "testuser1")
+		ci.FallbackSPNs = []string{"GRPC/new.test.gokrb5"}
+		ci.MutualAuth = mutual
+		defer ci.Close()
+		conn := dial(ci)
+		defer conn.Close()
+		client := test.NewServiceClient(conn)
+		stream, err := client.Mirror(context.Background())
+		if err != nil {
+			t.Fatalf("could not create client stream: %v", err)
+		}
+		if _, err := stream.Recv(); ErrorReason(err) != ReasonWrongSPN {
+			t.Errorf("mutual %t: expected the stream to be rejected for the SPN, got: %v", mutual, err)
+		}
+		c, _ := ci.chooseSPN(context.Background(), conn.Target(), "/Service/Mirror", nil)
+		if c.spn() != "GRPC/new.test.gokrb5" {
+			t.Errorf("mutual %t: expected the next candidate to be used after the stream was rejected, got %s", mutual, c.spn())
+		}
+		stream, err = client.Mirror(context.Background())
+		if err != nil {
+			t.Fatalf("could not create client stream: %v", err)
+		}
+		stream.CloseSend()
+		if _, err := stream.Recv(); err != io.EOF {
+			t.Errorf("mutual %t: stream with the next candidate failed: %v", mutual, err)
+		}
+	}
+}
@@ -0,0 +1,400 @@
+package grpc_krb
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"google.golang.org/grpc/codes"
+)
+
+// renewRetryInterval is how long to wait before trying again when renewing a ticket fails.
+const renewRetryInterval = 30 * time.Second
+
+// ticketCache holds the TGT and service tickets used by a client interceptor.
+// Concurrent lookups of the same ticket share a single request to the KDC and a background
+// goroutine renews tickets before they expire so that calls are not held up by the KDC.
+type ticketCache struct {
+	cl     *client.Client
+	ccache *ccacheSource
+
+	mux     sync.Mutex
+	tgt     *cachedTicket
+	tickets map[string]*cachedTicket
+	calls   map[string]*ticketCall
+
+	startOnce sync.Once
+	closeOnce sync.Once
+	wake      chan struct{}
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+type cachedTicket struct {
+	tkt       messages.Ticket
+	key       types.EncryptionKey
+	flags     asn1.BitString
+	authTime  time.Time
+	startTime time.Time
+	endTime   time.Time
+	renewTill time.Time
+	fetched   time.Time
+	lastUsed  time.Time
+	nextRenew time.Time
+	// refetch obtains the ticket again when it is renewed. It is not set for the TGT.
+	refetch func() (*cachedTicket, error)
+}
+
+// ticketCall is a request to the KDC that callers wanting the same ticket wait on.
+type ticketCall struct {
+	done chan struct{}
+	t    *cachedTicket
+	err  error
+}
+
+// tgtCacheKey is the key the TGT is requested under. It cannot clash with an SPN.
+const tgtCacheKey = ""
+
+func newTicketCache(cl *client.Client) *ticketCache {
+	return &ticketCache{
+		cl:      cl,
+		tickets: make(map[string]*cachedTicket),
+		calls:   make(map[string]*ticketCall),
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+func newCachedTicket(tkt messages.Ticket, dep messages.EncKDCRepPart) *cachedTicket {
+	t := &cachedTicket{
+		tkt:       tkt,
+		key:       dep.Key,
+		flags:     dep.Flags,
+		authTime:  dep.AuthTime,
+		startTime: dep.StartTime,
+		endTime:   dep.EndTime,
+		renewTill: dep.RenewTill,
+		fetched:   time.Now().UTC(),
+	}
+	if t.startTime.IsZero() {
+		t.startTime = dep.AuthTime
+	}
+	// renew once five sixths of the lifetime has passed, as gokrb5 does for its TGT sessions
+	t.nextRenew = t.endTime.Add(-t.endTime.Sub(t.startTime) / 6)
+	return t
+}
+
+func (t *cachedTicket) valid(now time.Time) bool {
+	return now.Before(t.endTime)
+}
+
+// get returns a service ticket and session key for the SPN, fetching one from the KDC if there is not a valid ticket cached.
+// If the context is done before the ticket is obtained the context's error is returned. The fetch from the KDC carries on
+// in the background for other callers and the cache.
+func (c *ticketCache) get(ctx context.Context, spn string) (messages.Ticket, types.EncryptionKey, error) {
+	return c.getTicket(ctx, spn, func() (*cachedTicket, error) {
+		return c.fetch(spn)
+	})
+}
+
+// getTicket returns the ticket cached under the key, calling fetch to obtain one if there is not a valid ticket cached.
+func (c *ticketCache) getTicket(ctx context.Context, key string, fetch func() (*cachedTicket, error)) (messages.Ticket, types.EncryptionKey, error) {
+	t, err := c.lookup(ctx, key, fetch)
+	if err != nil {
+		return messages.Ticket{}, types.EncryptionKey{}, err
+	}
+	return t.tkt, t.key, nil
+}
+
+// lookup returns the cached ticket for the key as getTicket does.
+func (c *ticketCache) lookup(ctx context.Context, key string, fetch func() (*cachedTicket, error)) (*cachedTicket, error) {
+	now := time.Now().UTC()
+	c.mux.Lock()
+	if t, ok := c.tickets[key]; ok && t.valid(now) {
+		t.lastUsed = now
+		c.mux.Unlock()
+		return t, nil
+	}
+	c.mux.Unlock()
+	t, err := c.do(ctx, key, renewable(fetch))
+	if err != nil {
+		return nil, err
+	}
+	c.mux.Lock()
+	t.lastUsed = time.Now().UTC()
+	c.mux.Unlock()
+	return t, nil
+}
+
+// do calls fn to obtain the ticket for the key unless a call for the key is already in flight, in which case its result is shared.
+// fn runs in its own goroutine so that it completes and the ticket obtained is stored in the cache even if the context is done first.
+func (c *ticketCache) do(ctx context.Context, key string, fn func() (*cachedTicket, error)) (*cachedTicket, error) {
+	c.mux.Lock()
+	call, ok := c.calls[key]
+	if !ok {
+		call = &ticketCall{done: make(chan struct{})}
+		c.calls[key] = call
+		go c.call(key, call, fn)
+	}
+	c.mux.Unlock()
+	select {
+	case <-call.done:
+		return call.t, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *ticketCache) call(key string, call *ticketCall, fn func() (*cachedTicket, error)) {
+	call.t, call.err = fn()
+	c.mux.Lock()
+	delete(c.calls, key)
+	if call.err == nil {
+		if key == tgtCacheKey {
+			c.tgt = call.t
+		} else {
+			c.tickets[key] = call.t
+		}
+	}
+	c.mux.Unlock()
+	close(call.done)
+	if call.err == nil {
+		c.startRenewal()
+	}
+}
+
+// renewable returns a function calling fetch that sets the tickets obtained to be renewed by calling fetch again.
+func renewable(fetch func() (*cachedTicket, error)) func() (*cachedTicket, error) {
+	return func() (*cachedTicket, error) {
+		t, err := fetch()
+		if err != nil {
+			return nil, err
+		}
+		t.refetch = fetch
+		return t, nil
+	}
+}
+
+// fetch requests a new service ticket for the SPN from the KDC of its realm, which is taken from the SPN or found with spnRealm.
+func (c *ticketCache) fetch(spn string) (*cachedTicket, error) {
+	tgt, err := c.getTGT()
+	if err != nil {
+		return nil, err
+	}
+	princ, realm := types.ParseSPNString(spn)
+	if realm == "" {
+		realm = c.spnRealm(princ)
+	}
+	// the KDC of the service's realm is asked with a TGT for that realm. gokrb5 follows any referral to another realm.
+	tkt, key := tgt.tkt, tgt.key
+	if realm != c.cl.Credentials.Domain() {
+		xtgt, err := c.crossRealmTGT(realm)
+		if err != nil {
+			return nil, err
+		}
+		tkt, key = xtgt.tkt, xtgt.key
+	}
+	_, tgsRep, err := c.cl.TGSREQGenerateAndExchange(princ, realm, tkt, key, false)
+	if err != nil {
+		return nil, err
+	}
+	return newCachedTicket(tgsRep.Ticket, tgsRep.DecryptedEncPart), nil
+}
+
+// getTGT returns the TGT, logging in to the KDC if there is none or it is due for renewal.
+// If logging in fails a TGT that has not yet expired is still returned.
+func (c *ticketCache) getTGT() (*cachedTicket, error) {
+	now := time.Now().UTC()
+	c.mux.Lock()
+	tgt := c.tgt
+	c.mux.Unlock()
+	if tgt != nil && now.Before(tgt.nextRenew) {
+		return tgt, nil
+	}
+	t, err := c.do(context.Background(), tgtCacheKey, c.login)
+	if err != nil {
+		if tgt != nil && tgt.valid(now) {
+			return tgt, nil
+		}
+		return nil, err
+	}
+	return t, nil
+}
+
+// login performs an AS exchange with the KDC to obtain a new TGT, or reads it from the credential cache if there is one.
+func (c *ticketCache) login() (*cachedTicket, error) {
+	if c.ccache != nil {
+		return c.ccache.login()
+	}
+	if !c.cl.Credentials.HasKeytab() && !c.cl.Credentials.HasPassword() {
+		return c.sessionTGT()
+	}
+	realm := c.cl.Credentials.Domain()
+	asReq, err := messages.NewASReqForTGT(realm, c.cl.Config, c.cl.Credentials.CName())
+	if err != nil {
+		return nil, err
+	}
+	asRep, err := c.cl.ASExchange(realm, asReq, 0)
+	if err != nil {
+		return nil, err
+	}
+	return newCachedTicket(asRep.Ticket, asRep.DecryptedEncPart), nil
+}
+
+// sessionTGT obtains a TGT for a client without a keytab or password, such as one created with client.NewFromCCache
+// or from a forwarded TGT, from the TGT the client holds. That TGT is exchanged for a new one so that its lifetime is known.
+func (c *ticketCache) sessionTGT() (*cachedTicket, error) {
+	realm := c.cl.Credentials.Domain()
+	spn := "krbtgt/" + realm
+	tkt, key, ok := c.cl.GetCachedTicket(spn)
+	if !ok {
+		return nil, authError(codes.Unauthenticated, ReasonCredentialsExpired,
+			"%s has no valid TGT and no keytab or password to obtain one with", c.cl.Credentials.CName().PrincipalNameString())
+	}
+	req, err := newTGSReq(c.cl, tkt, key, types.NewPrincipalName(nametype.KRB_NT_SRV_INST, spn), realm, nil)
+	if err != nil {
+		return nil, err
+	}
+	rep, err := tgsExchange(c.cl, req, realm, key)
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := rep.Verify(c.cl.Config, req); !ok {
+		return nil, err
+	}
+	return newCachedTicket(rep.Ticket, rep.DecryptedEncPart), nil
+}
+
+// reset drops all the tickets held so that they are obtained afresh from the KDC.
+func (c *ticketCache) reset() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.tgt = nil
+	c.tickets = make(map[string]*cachedTicket)
+}
+
+func (c *ticketCache) startRenewal() {
+	c.startOnce.Do(func() {
+		go c.renewLoop()
+	})
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// close stops the background renewal of tickets.
+func (c *ticketCache) close() {
+	c.closeOnce.Do(func() {
+		// stop the renewal goroutine being started after close
+		c.startOnce.Do(func() {
+			close(c.done)
+		})
+		close(c.stop)
+	})
+	<-c.done
+}
+
+func (c *ticketCache) renewLoop() {
+	defer close(c.done)
+	for {
+		// with nothing to renew the loop waits to be woken when a ticket is added
+		timer := time.NewTimer(time.Hour)
+		if next, ok := c.nextRenewal(); ok {
+			timer.Reset(time.Until(next))
+		}
+		select {
+		case <-c.stop:
+			timer.Stop()
+			return
+		case <-c.wake:
+			timer.Stop()
+		case <-timer.C:
+			c.renew()
+		}
+	}
+}
+
+// nextRenewal returns the earliest time a ticket is due for renewal.
+func (c *ticketCache) nextRenewal() (time.Time, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	var next time.Time
+	if c.tgt != nil {
+		next = c.tgt.nextRenew
+	}
+	for _, t := range c.tickets {
+		if next.IsZero() || t.nextRenew.Before(next) {
+			next = t.nextRenew
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// renew refreshes the TGT and service tickets that are due for renewal.
+// Service tickets that have not been used since they were last obtained are left to expire rather than renewed.
+func (c *ticketCache) renew() {
+	now := time.Now().UTC()
+	c.mux.Lock()
+	tgtDue := c.tgt != nil && !now.Before(c.tgt.nextRenew)
+	due := make(map[string]func() (*cachedTicket, error))
+	for key, t := range c.tickets {
+		if now.Before(t.nextRenew) {
+			continue
+		}
+		if t.lastUsed.Before(t.fetched) {
+			if !t.valid(now) {
+				delete(c.tickets, key)
+			} else {
+				t.nextRenew = t.endTime
+			}
+			continue
+		}
+		due[key] = t.refetch
+	}
+	c.mux.Unlock()
+
+	if tgtDue {
+		_, err := c.do(context.Background(), tgtCacheKey, c.login)
+		if err != nil {
+			c.cl.Log("error renewing TGT: %v", err)
+			c.retryLater(tgtCacheKey)
+		}
+	}
+	for key, fetch := range due {
+		_, err := c.do(context.Background(), key, renewable(fetch))
+		if err != nil {
+			c.cl.Log("error renewing service ticket for %s: %v", key, err)
+			c.retryLater(key)
+		}
+	}
+}
+
+// retryLater puts back the renewal of a ticket after a failure, dropping it if it has expired.
+func (c *ticketCache) retryLater(key string) {
+	now := time.Now().UTC()
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	t := c.tgt
+	if key != tgtCacheKey {
+		t = c.tickets[key]
+	}
+	if t == nil {
+		return
+	}
+	if !t.valid(now) {
+		if key == tgtCacheKey {
+			c.tgt = nil
+		} else {
+			delete(c.tickets, key)
+		}
+		return
+	}
+	t.nextRenew = now.Add(renewRetryInterval)
+}
@@ -0,0 +1,93 @@
+package grpc_krb
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/grpckrb/test"
+)
+
+func TestTicketCache_ConcurrentCalls(t *testing.T) {
+	srv, addr, errChan := newTestServer(0)
+	if srv == nil {
+		t.Fatal("could not create grpc server")
+	}
+	ci := newClientInterceptor("", "testuser1")
+	defer ci.Close()
+	conn, err := connectWithInterceptor(addr.String(), ci)
+	if err != nil {
+		t.Fatalf("could not create client connection: %v", err)
+	}
+	defer conn.Close()
+	client := test.NewServiceClient(conn)
+
+	before := testKDC.Requests()
+	var wg sync.WaitGroup
+	for n := 0; n < 50; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.Reflector(context.Background(), &test.Request{RequestInt: 1})
+			if err != nil {
+				t.Errorf("error in sending message: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	// one AS exchange for the TGT and one TGS exchange for the service ticket
+	if n := testKDC.Requests() - before; n != 2 {
+		t.Errorf("expected 2 requests to the KDC, got %d", n)
+	}
+
+	go srv.GracefulStop()
+	for err := range errChan {
+		if err != nil {
+			t.Errorf("error from grpc server: %v", err)
+		}
+	}
+}
+
+func TestTicketCache_Renewal(t *testing.T) {
+	testKDC.TicketLifetime = 3 * time.Second
+	defer func() { testKDC.TicketLifetime = 0 }()
+	srv, addr, errChan := newTestServer(0)
+	if srv == nil {
+		t.Fatal("could not create grpc server")
+	}
+	ci := newClientInterceptor("", "testuser1")
+	defer ci.Close()
+	conn, err := connectWithInterceptor(addr.String(), ci)
+	if err != nil {
+		t.Fatalf("could not create client connection: %v", err)
+	}
+	defer conn.Close()
+	client := test.NewServiceClient(conn)
+
+	_, err = client.Reflector(context.Background(), &test.Request{RequestInt: 1})
+	if err != nil {
+		t.Fatalf("error in sending message: %v", err)
+	}
+	before := testKDC.Requests()
+	// the TGT and service ticket are renewed in the background before they expire
+	time.Sleep(3 * time.Second)
+	renewed := testKDC.Requests()
+	if renewed-before != 2 {
+		t.Errorf("expected the TGT and service ticket to be renewed, got %d requests to the KDC", renewed-before)
+	}
+	_, err = client.Reflector(context.Background(), &test.Request{RequestInt: 1})
+	if err != nil {
+		t.Fatalf("error in sending message after renewal: %v", err)
+	}
+	if testKDC.Requests() != renewed {
+		t.Error("call after renewal should not have needed the KDC")
+	}
+
+	go srv.GracefulStop()
+	for err := range errChan {
+		if err != nil {
+			t.Errorf("error from grpc server: %v", err)
+		}
+	}
+}
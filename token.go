@@ -0,0 +1,227 @@
+package grpc_krb
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+)
+
+// TokenFormat defines how the Kerberos messages are encoded in the GRPC metadata.
+type TokenFormat int
+
+const (
+	// TokenFormatRaw is a base64 encoded KRB_AP_REQ or KRB_AP_REP.
+	TokenFormatRaw TokenFormat = iota
+	// TokenFormatSPNEGO is the HTTP Negotiate format of "Negotiate <base64 SPNEGO token>" as produced by GSSAPI/SPNEGO libraries.
+	TokenFormatSPNEGO
+	// TokenFormatGSSAPI is a base64 encoded RFC 4121 initial context token as produced by gss_init_sec_context.
+	TokenFormatGSSAPI
+)
+
+const (
+	negotiatePrefix = "Negotiate "
+	// gssTokenTag is the leading byte of a GSS-API initial context token, [APPLICATION 0] constructed.
+	gssTokenTag = 0x60
+	// gssChecksumBndLength is the length of the channel binding hash in the RFC 4121 authenticator checksum.
+	gssChecksumBndLength = 16
+)
+
+var (
+	tokIDAPReq = []byte{0x01, 0x00}
+	tokIDAPRep = []byte{0x02, 0x00}
+)
+
+// encodeAPReq encodes the marshaled AP_REQ for the authorization metadata.
+func encodeAPReq(b []byte, format TokenFormat) (string, error) {
+	switch format {
+	case TokenFormatRaw:
+		return base64.StdEncoding.EncodeToString(b), nil
+	case TokenFormatGSSAPI:
+		return base64.StdEncoding.EncodeToString(wrapKRB5Token(tokIDAPReq, b)), nil
+	}
+	tkn := spnego.SPNEGOToken{
+		Init: true,
+		NegTokenInit: spnego.NegTokenInit{
+			MechTypes:      []asn1.ObjectIdentifier{gssapi.OIDKRB5.OID()},
+			MechTokenBytes: wrapKRB5Token(tokIDAPReq, b),
+		},
+	}
+	sb, err := tkn.Marshal()
+	if err != nil {
+		return "", err
+	}
+	return negotiatePrefix + base64.StdEncoding.EncodeToString(sb), nil
+}
+
+// decodeAPReq decodes the AP_REQ from the authorization metadata value and reports the format it was sent in.
+func decodeAPReq(v string) (*messages.APReq, TokenFormat, error) {
+	if !hasNegotiatePrefix(v) {
+		b, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, TokenFormatRaw, errors.New("malformed authorization token")
+		}
+		if len(b) > 0 && b[0] == gssTokenTag {
+			var mt spnego.KRB5Token
+			err = mt.Unmarshal(b)
+			if err != nil || !mt.IsAPReq() {
+				return nil, TokenFormatGSSAPI, errors.New("malformed GSS-API authorization token")
+			}
+			return &mt.APReq, TokenFormatGSSAPI, nil
+		}
+		apReq := new(messages.APReq)
+		err = apReq.Unmarshal(b)
+		if err != nil {
+			return nil, TokenFormatRaw, errors.New("malformed AP_REQ authorization token")
+		}
+		return apReq, TokenFormatRaw, nil
+	}
+
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v[len(negotiatePrefix):]))
+	if err != nil {
+		return nil, TokenFormatSPNEGO, errors.New("malformed SPNEGO authorization token")
+	}
+	var tkn spnego.SPNEGOToken
+	err = tkn.Unmarshal(b)
+	if err != nil || !tkn.Init {
+		return nil, TokenFormatSPNEGO, errors.New("malformed SPNEGO authorization token")
+	}
+	var krb5 bool
+	for _, m := range tkn.NegTokenInit.MechTypes {
+		if m.Equal(gssapi.OIDKRB5.OID()) || m.Equal(gssapi.OIDMSLegacyKRB5.OID()) {
+			krb5 = true
+			break
+		}
+	}
+	if !krb5 {
+		return nil, TokenFormatSPNEGO, errors.New("SPNEGO authorization token does not offer the Kerberos mechanism")
+	}
+	var mt spnego.KRB5Token
+	err = mt.Unmarshal(tkn.NegTokenInit.MechTokenBytes)
+	if err != nil || !mt.IsAPReq() {
+		return nil, TokenFormatSPNEGO, errors.New("SPNEGO authorization token does not contain a Kerberos AP_REQ")
+	}
+	return &mt.APReq, TokenFormatSPNEGO, nil
+}
+
+// encodeAPRep encodes the marshaled AP_REP for the response metadata.
+// For SPNEGO a NegTokenResp is always returned to complete the negotiation. b may be nil if mutual authentication was not requested.
+func encodeAPRep(b []byte, format TokenFormat) (string, error) {
+	switch format {
+	case TokenFormatRaw:
+		return base64.StdEncoding.EncodeToString(b), nil
+	case TokenFormatGSSAPI:
+		return base64.StdEncoding.EncodeToString(wrapKRB5Token(tokIDAPRep, b)), nil
+	}
+	tkn := spnego.SPNEGOToken{
+		Resp: true,
+		NegTokenResp: spnego.NegTokenResp{
+			NegState:      asn1.Enumerated(spnego.NegStateAcceptCompleted),
+			SupportedMech: gssapi.OIDKRB5.OID(),
+		},
+	}
+	if b != nil {
+		tkn.NegTokenResp.ResponseToken = wrapKRB5Token(tokIDAPRep, b)
+	}
+	sb, err := tkn.Marshal()
+	if err != nil {
+		return "", err
+	}
+	return negotiatePrefix + base64.StdEncoding.EncodeToString(sb), nil
+}
+
+// decodeAPRep decodes the AP_REP from the response metadata value.
+func decodeAPRep(v string, format TokenFormat) (*messages.APRep, error) {
+	if format != TokenFormatSPNEGO {
+		b, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, errors.New("malformed AP_REP")
+		}
+		if format == TokenFormatGSSAPI {
+			var mt spnego.KRB5Token
+			err = mt.Unmarshal(b)
+			if err != nil || !mt.IsAPRep() {
+				return nil, errors.New("malformed GSS-API AP_REP token")
+			}
+			return &mt.APRep, nil
+		}
+		apRep := new(messages.APRep)
+		err = apRep.Unmarshal(b)
+		if err != nil {
+			return nil, err
+		}
+		return apRep, nil
+	}
+
+	if !hasNegotiatePrefix(v) {
+		return nil, errors.New("reply is not a SPNEGO token")
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v[len(negotiatePrefix):]))
+	if err != nil {
+		return nil, errors.New("malformed SPNEGO reply")
+	}
+	var tkn spnego.SPNEGOToken
+	err = tkn.Unmarshal(b)
+	if err != nil || !tkn.Resp {
+		return nil, errors.New("malformed SPNEGO reply")
+	}
+	if tkn.NegTokenResp.State() != spnego.NegStateAcceptCompleted {
+		return nil, fmt.Errorf("SPNEGO negotiation not completed, state %d", tkn.NegTokenResp.State())
+	}
+	var mt spnego.KRB5Token
+	err = mt.Unmarshal(tkn.NegTokenResp.ResponseToken)
+	if err != nil || !mt.IsAPRep() {
+		return nil, errors.New("SPNEGO reply does not contain a Kerberos AP_REP")
+	}
+	return &mt.APRep, nil
+}
+
+// wrapKRB5Token frames the Kerberos message as a GSS-API token for the Kerberos mechanism (RFC 1964 section 1.1).
+func wrapKRB5Token(tokID, b []byte) []byte {
+	ob, _ := asn1.Marshal(gssapi.OIDKRB5.OID())
+	t := append(ob, tokID...)
+	t = append(t, b...)
+	return asn1tools.AddASNAppTag(t, 0)
+}
+
+func hasNegotiatePrefix(v string) bool {
+	return len(v) >= len(negotiatePrefix) && strings.EqualFold(v[:len(negotiatePrefix)], negotiatePrefix)
+}
+
+// newGSSChecksum creates the RFC 4121 section 4.1.1 authenticator checksum value with the channel binding hash and context flags provided.
+func newGSSChecksum(bnd []byte, flags uint32) []byte {
+	b := make([]byte, 24)
+	binary.LittleEndian.PutUint32(b[0:4], gssChecksumBndLength)
+	copy(b[4:20], bnd)
+	binary.LittleEndian.PutUint32(b[20:24], flags)
+	return b
+}
+
+// parseGSSChecksum returns the channel binding hash and context flags from an RFC 4121 authenticator checksum value.
+func parseGSSChecksum(b []byte) ([]byte, uint32, error) {
+	if len(b) < 24 {
+		return nil, 0, errors.New("checksum too short")
+	}
+	if binary.LittleEndian.Uint32(b[0:4]) != gssChecksumBndLength {
+		return nil, 0, errors.New("unexpected channel binding length")
+	}
+	return b[4:20], binary.LittleEndian.Uint32(b[20:24]), nil
+}
+
+// methodChannelBindings returns the MD5 hash of GSS-API channel bindings with no addresses and the GRPC method as the application data.
+// GSS-API peers can bind a token to a method by passing the method name as the application data of their channel bindings.
+func methodChannelBindings(method string) []byte {
+	b := make([]byte, 20, 20+len(method))
+	binary.LittleEndian.PutUint32(b[16:20], uint32(len(method)))
+	b = append(b, method...)
+	h := md5.Sum(b)
+	return h[:]
+}